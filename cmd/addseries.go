@@ -0,0 +1,93 @@
+// Copyright 2022
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"os"
+	"time"
+
+	"github.com/penny-vault/import-fred/fred"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	rootCmd.AddCommand(addSeriesCmd)
+
+	addSeriesCmd.Flags().String("source", fred.SourceFRED, "source that publishes the series")
+	err := viper.BindPFlag("add_series.source", addSeriesCmd.Flags().Lookup("source"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not bind pflag for add_series.source")
+	}
+
+	addSeriesCmd.Flags().Bool("backfill", false, "download the full history of the added series")
+	err = viper.BindPFlag("add_series.backfill", addSeriesCmd.Flags().Lookup("backfill"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not bind pflag for add_series.backfill")
+	}
+}
+
+var addSeriesCmd = &cobra.Command{
+	Use:   "add-series SERIES_ID...",
+	Short: "Register series in the assets table",
+	Long: `Validate each series against its source and register it as an active
+asset. The composite_figi column is set to a deterministic synthetic FIGI
+derived from the asset type and series id.
+
+A FRED units transformation may be appended to the series id to register
+a derived series, e.g. CPIAUCSL:pc1 for the year-over-year percent change
+of CPI. Derived series are downloaded with the transformation applied by
+FRED and stored under their own ticker and FIGI. Supported
+transformations: chg, ch1, pch, pc1, pca, cch, cca and log.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := cmd.Context()
+
+		src, err := fred.NewSource(viper.GetString("add_series.source"))
+		if err != nil {
+			log.Fatal().Err(err).Msg("could not create source")
+		}
+		if viper.GetBool("add_series.backfill") {
+			checkVintages(fred.Sources{src.AssetType(): src})
+		}
+
+		migrateSchema(ctx)
+		assets, addErr := fred.AddSeries(ctx, src, args)
+
+		if viper.GetBool("add_series.backfill") && len(assets) > 0 {
+			runBackfill(ctx, fred.Sources{src.AssetType(): src}, assets, backfillSince(assets))
+		}
+
+		if addErr != nil {
+			os.Exit(1)
+		}
+	},
+}
+
+// backfillSince returns the earliest first observation of assets, or
+// FullHistoryStart when it is not known for every asset
+func backfillSince(assets []*fred.Asset) time.Time {
+	var since time.Time
+	for _, asset := range assets {
+		if asset.ObservationStart.IsZero() {
+			return fred.FullHistoryStart
+		}
+		if since.IsZero() || asset.ObservationStart.Before(since) {
+			since = asset.ObservationStart
+		}
+	}
+	return since
+}
@@ -0,0 +1,95 @@
+// Copyright 2022
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"time"
+
+	"github.com/penny-vault/import-fred/fred"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	rootCmd.AddCommand(backfillCmd)
+
+	backfillCmd.Flags().AddFlagSet(downloadFlags)
+	backfillCmd.Flags().AddFlagSet(outputFlags)
+
+	backfillCmd.Flags().StringSliceP("ticker", "t", []string{}, "FRED series to backfill (may be repeated or comma separated)")
+	err := viper.BindPFlag("backfill.tickers", backfillCmd.Flags().Lookup("ticker"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not bind pflag for backfill.tickers")
+	}
+
+	backfillCmd.Flags().String("since", fred.FullHistoryStart.Format("2006-01-02"), "first observation date to download (YYYY-MM-DD); series whose first observation is known are not requested before it")
+	err = viper.BindPFlag("backfill.since", backfillCmd.Flags().Lookup("since"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not bind pflag for backfill.since")
+	}
+
+	backfillCmd.Flags().Int("chunk-years", 10, "number of years to request from fred at a time")
+	err = viper.BindPFlag("backfill.chunk_years", backfillCmd.Flags().Lookup("chunk-years"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not bind pflag for backfill.chunk_years")
+	}
+}
+
+var backfillCmd = &cobra.Command{
+	Use:   "backfill",
+	Short: "Download the full history of selected series",
+	Long: `Download the full observation history of selected series and save to
+penny-vault database. Missing trading days are forward-filled over the
+entire backfilled range.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := cmd.Context()
+
+		tickers := viper.GetStringSlice("backfill.tickers")
+		if len(tickers) == 0 {
+			log.Fatal().Msg("at least one --ticker is required")
+		}
+
+		since, err := time.Parse("2006-01-02", viper.GetString("backfill.since"))
+		if err != nil {
+			log.Fatal().Err(err).Str("Since", viper.GetString("backfill.since")).Msg("could not parse since date")
+		}
+
+		sources, err := fred.NewSourcesFromConfig()
+		if err != nil {
+			log.Fatal().Err(err).Msg("could not create sources")
+		}
+		checkVintages(sources)
+
+		migrateSchema(ctx)
+		assets := fred.LoadAssetsByTicker(ctx, sources.AssetTypes(), tickers)
+		runBackfill(ctx, sources, assets, since)
+	},
+}
+
+// runBackfill downloads and saves the history of assets since the given
+// date and fills the entire range
+func runBackfill(ctx context.Context, sources fred.Sources, assets []*fred.Asset, since time.Time) {
+	sink := openSink(ctx)
+	results := fred.Backfill(ctx, sources, assets, since, time.Now(), viper.GetInt("backfill.chunk_years"), sink)
+	closeSink(ctx, sink)
+	refreshMetadata(ctx, sources, assets)
+	filled := fillAssets(ctx, results, func(ctx context.Context, asset *fred.Asset) error {
+		return fred.FillSince(ctx, asset, since)
+	})
+	computeDerived(ctx, sources)
+	exitOnFailures(ctx, results, filled)
+}
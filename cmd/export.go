@@ -0,0 +1,163 @@
+// Copyright 2022
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/penny-vault/import-fred/fred"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	rootCmd.AddCommand(exportCmd)
+
+	exportCmd.Flags().AddFlagSet(outputFlags)
+
+	exportCmd.Flags().StringSliceP("ticker", "t", []string{}, "series to export (may be repeated or comma separated), including deactivated ones; all active assets when omitted")
+	err := viper.BindPFlag("export.tickers", exportCmd.Flags().Lookup("ticker"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not bind pflag for export.tickers")
+	}
+
+	exportCmd.Flags().String("since", fred.FullHistoryStart.Format("2006-01-02"), "first event date to export (YYYY-MM-DD)")
+	err = viper.BindPFlag("export.since", exportCmd.Flags().Lookup("since"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not bind pflag for export.since")
+	}
+
+	exportCmd.Flags().String("until", "", "last event date to export (YYYY-MM-DD); defaults to today")
+	err = viper.BindPFlag("export.until", exportCmd.Flags().Lookup("until"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not bind pflag for export.until")
+	}
+
+	exportCmd.Flags().Bool("include-filled", true, "export the forward-filled quotes (source api.pennyvault.com) as well as the observations")
+	err = viper.BindPFlag("export.include_filled", exportCmd.Flags().Lookup("include-filled"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not bind pflag for export.include_filled")
+	}
+
+	exportCmd.Flags().String("as-of", "", "export the values as they were published on this date (YYYY-MM-DD) from the vintages stored with --vintages")
+	err = viper.BindPFlag("export.as_of", exportCmd.Flags().Lookup("as-of"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not bind pflag for export.as_of")
+	}
+
+	exportCmd.Flags().String("format", "", "output format (parquet, csv, ndjson, arrow); by default chosen by the extension of --out, falling back to parquet")
+	err = viper.BindPFlag("export.format", exportCmd.Flags().Lookup("format"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not bind pflag for export.format")
+	}
+
+	exportCmd.Flags().StringP("out", "o", "", "output file, or a directory (ending in /) to write partitioned files and a manifest as with --output-dir")
+	err = viper.BindPFlag("export.out", exportCmd.Flags().Lookup("out"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not bind pflag for export.out")
+	}
+}
+
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Write stored series from the database to files",
+	Long: `Read the quotes of the selected series from the eod table and write them
+to a file or a partitioned directory, e.g.
+
+  import-fred export --ticker DGS10,UNRATE --since 2000-01-01 --format parquet --out data/
+
+Directories are laid out by --partition-by and include a manifest of the
+files written. Derived series are exported alongside the downloaded ones.
+With --as-of the values are exported as they were published on that date,
+before any later revisions, for series downloaded with --vintages.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := cmd.Context()
+
+		out := viper.GetString("export.out")
+		if out == "" {
+			log.Fatal().Msg("--out is required")
+		}
+
+		opts := fred.ExportOptions{IncludeFilled: viper.GetBool("export.include_filled")}
+
+		var err error
+		opts.Since, err = time.Parse("2006-01-02", viper.GetString("export.since"))
+		if err != nil {
+			log.Fatal().Err(err).Str("Since", viper.GetString("export.since")).Msg("could not parse since date")
+		}
+
+		if until := viper.GetString("export.until"); until != "" {
+			opts.Until, err = time.Parse("2006-01-02", until)
+			if err != nil {
+				log.Fatal().Err(err).Str("Until", until).Msg("could not parse until date")
+			}
+		}
+
+		if asOf := viper.GetString("export.as_of"); asOf != "" {
+			opts.AsOf, err = time.Parse("2006-01-02", asOf)
+			if err != nil {
+				log.Fatal().Err(err).Str("AsOf", asOf).Msg("could not parse as-of date")
+			}
+		}
+
+		sources, err := fred.NewSourcesFromConfig()
+		if err != nil {
+			log.Fatal().Err(err).Msg("could not create sources")
+		}
+
+		assetTypes := append(sources.AssetTypes(), fred.AssetTypeDerived)
+
+		assets := fred.LoadExportAssets(ctx, assetTypes, viper.GetStringSlice("export.tickers"))
+
+		sink := openExportSink(ctx, out, viper.GetString("export.format"))
+		numQuotes, exportErr := fred.Export(ctx, sources, assets, opts, sink)
+		if err = sink.Close(context.WithoutCancel(ctx)); err != nil {
+			log.Error().Err(err).Msg("failed to close output")
+		}
+
+		log.Info().Int("NumAssets", len(assets)).Int("NumQuotes", numQuotes).Str("Out", out).Msg("export finished")
+
+		if exportErr != nil || err != nil {
+			os.Exit(1)
+		}
+	},
+}
+
+// openExportSink opens the export output. Paths that end in a separator or
+// name an existing directory are written as a partitioned directory.
+func openExportSink(ctx context.Context, out, format string) fred.Sink {
+	isDir := strings.HasSuffix(out, "/") || strings.HasSuffix(out, string(os.PathSeparator))
+	if info, err := os.Stat(out); err == nil && info.IsDir() {
+		isDir = true
+	}
+
+	if isDir {
+		sink, err := fred.NewPartitionedSink(ctx, out, format, viper.GetStringSlice("partition_by"), viper.GetString("manifest_file"))
+		if err != nil {
+			log.Fatal().Err(err).Msg("could not create partitioned output")
+		}
+		return sink
+	}
+
+	sink, err := fred.NewFileSink(ctx, out, format)
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not create output file")
+	}
+	return sink
+}
@@ -0,0 +1,63 @@
+// Copyright 2022
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"os"
+
+	"github.com/penny-vault/import-fred/fred"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	rootCmd.AddCommand(migrateCmd)
+
+	migrateCmd.Flags().Bool("widen-eod", false, "change the real price columns of eod to double precision; rewrites eod and blocks other readers and writers until it completes")
+	err := viper.BindPFlag("migrate.widen_eod", migrateCmd.Flags().Lookup("widen-eod"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not bind pflag for migrate.widen_eod")
+	}
+}
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Create or update the database schema",
+	Long: `Create the tables and columns import-fred writes to, as every command that
+changes the database does on startup. With --widen-eod the price columns of
+the shared eod table are also changed from real to double precision so that
+observations are stored without rounding. The change rewrites eod and holds
+an exclusive lock on it until it completes; run it when no other importer
+is using the table.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := cmd.Context()
+
+		if viper.GetString("database.url") == "" {
+			log.Fatal().Msg("database.url is required")
+		}
+
+		migrateSchema(ctx)
+
+		if !viper.GetBool("migrate.widen_eod") {
+			return
+		}
+
+		if err := fred.WidenEodPrices(ctx); err != nil {
+			log.Error().Err(err).Msg("could not widen eod price columns")
+			os.Exit(1)
+		}
+	},
+}
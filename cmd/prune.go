@@ -0,0 +1,95 @@
+// Copyright 2022
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/penny-vault/import-fred/fred"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	rootCmd.AddCommand(pruneCmd)
+
+	pruneCmd.Flags().Duration("grace-period", 90*24*time.Hour, "time past a series' expected next observation before it is pruned")
+	err := viper.BindPFlag("prune.grace_period", pruneCmd.Flags().Lookup("grace-period"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not bind pflag for prune.grace_period")
+	}
+
+	pruneCmd.Flags().Bool("apply", false, "deactivate the reported assets; without this flag prune only reports")
+	err = viper.BindPFlag("prune.apply", pruneCmd.Flags().Lookup("apply"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not bind pflag for prune.apply")
+	}
+}
+
+var pruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Deactivate discontinued series",
+	Long: `Check the metadata of each active asset and report series that FRED has
+discontinued or that have stopped publishing new observations for longer
+than the grace period. With --apply the reported assets are marked
+inactive, the reason is recorded in asset_deactivations and they are no
+longer downloaded or filled.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := cmd.Context()
+
+		sources, err := fred.NewSourcesFromConfig()
+		if err != nil {
+			log.Fatal().Err(err).Msg("could not create sources")
+		}
+
+		migrateSchema(ctx)
+		assets := fred.LoadAssetsFromDB(ctx, sources.AssetTypes())
+		refreshMetadata(ctx, sources, assets)
+
+		candidates, err := fred.FindPruneCandidates(ctx, sources.AssetTypes(), viper.GetDuration("prune.grace_period"))
+		if err != nil {
+			log.Fatal().Err(err).Msg("could not check assets for pruning")
+		}
+
+		printPruneCandidates(candidates)
+
+		if !viper.GetBool("prune.apply") || len(candidates) == 0 {
+			return
+		}
+
+		if err = fred.Deactivate(ctx, candidates); err != nil {
+			log.Error().Err(err).Msg("could not deactivate assets")
+			os.Exit(1)
+		}
+	},
+}
+
+// printPruneCandidates renders the assets that would be deactivated as an
+// aligned table on stdout
+func printPruneCandidates(candidates []*fred.PruneCandidate) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TICKER\tREASON\tLAST OBS\tTITLE")
+	for _, candidate := range candidates {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", candidate.Asset.Ticker, candidate.Reason,
+			candidate.ObservationEnd.Format("2006-01-02"), truncate(candidate.Title, 60))
+	}
+	if err := w.Flush(); err != nil {
+		log.Error().Err(err).Msg("could not write prune report")
+	}
+}
@@ -16,14 +16,19 @@ limitations under the License.
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/penny-vault/import-fred/fred"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
@@ -37,41 +42,212 @@ var rootCmd = &cobra.Command{
 	// Uncomment the following line if your bare application
 	// has an action associated with it:
 	Run: func(cmd *cobra.Command, args []string) {
-		assets := fred.LoadAssetsFromDB()
+		ctx := cmd.Context()
+
+		sources, err := fred.NewSourcesFromConfig()
+		if err != nil {
+			log.Fatal().Err(err).Msg("could not create sources")
+		}
+		checkVintages(sources)
+
+		migrateSchema(ctx)
+		assets := fred.LoadAssetsFromDB(ctx, sources.AssetTypes())
 
 		limit := viper.GetInt("limit")
 		if limit > 0 {
 			assets = assets[:limit]
 		}
 
-		quotes := fred.Fetch(assets)
-		if viper.GetString("parquet_file") != "" {
-			err := fred.SaveToParquet(quotes, viper.GetString("parquet_file"))
-			if err != nil {
-				log.Error().Err(err).Msg("failed to save to parquet file")
-			}
+		sink := openSink(ctx)
+		results := fred.Fetch(ctx, sources, assets, sink)
+		closeSink(ctx, sink)
+		refreshMetadata(ctx, sources, assets)
+		filled := fillAssets(ctx, results, fred.Fill)
+		computeDerived(ctx, sources)
+		exitOnFailures(ctx, results, filled)
+	},
+}
+
+// fillAssets forward-fills each successfully downloaded asset. Assets that
+// failed are skipped; the gap would be papered over with stale values.
+// Once ctx is done no further assets are filled, but the fill in progress
+// runs to completion. It returns the number of assets filled.
+func fillAssets(ctx context.Context, results []*fred.AssetResult, fill func(context.Context, *fred.Asset) error) int {
+	filled := 0
+	for _, result := range results {
+		if ctx.Err() != nil {
+			break
+		}
+		if result.Failed() {
+			continue
+		}
+		err := fill(context.WithoutCancel(ctx), result.Asset)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to fill missing assets")
+			continue
 		}
+		filled++
+	}
+	return filled
+}
 
-		if viper.GetString("database.url") != "" {
-			err := fred.SaveToDatabase(quotes)
-			if err != nil {
-				log.Error().Err(err).Msg("failed to save to database")
+// exitOnFailures logs a summary of the run and exits with a non-zero
+// status if any asset failed or the run was interrupted
+func exitOnFailures(ctx context.Context, results []*fred.AssetResult, filled int) {
+	completed := 0
+	canceled := 0
+	for _, result := range results {
+		switch {
+		case result.Canceled():
+			canceled++
+		case result.Failed():
+			log.Error().Err(result.Err).Str("Ticker", result.Asset.Ticker).Int("Retries", result.Retries).Msg("asset failed to download")
+		default:
+			completed++
+			if result.Retries > 0 {
+				log.Info().Str("Ticker", result.Asset.Ticker).Int("Retries", result.Retries).Msg("asset downloaded after retrying")
 			}
 		}
+	}
 
-		for _, asset := range assets {
-			err := fred.Fill(asset)
-			if err != nil {
-				log.Error().Err(err).Msg("failed to fill missing assets")
-			}
+	failed := len(results) - completed - canceled
+	log.Info().
+		Int("NumAssets", len(results)).
+		Int("NumDownloaded", completed).
+		Int("NumFailed", failed).
+		Int("NumCanceled", canceled).
+		Int("NumFilled", filled).
+		Bool("Interrupted", ctx.Err() != nil).
+		Msg("run finished")
+
+	if failed > 0 || ctx.Err() != nil {
+		os.Exit(1)
+	}
+}
+
+// migrateSchema creates the tables and columns import-fred writes to. It
+// runs once at the start of each command that changes the database.
+func migrateSchema(ctx context.Context) {
+	if viper.GetString("database.url") == "" {
+		return
+	}
+
+	if err := fred.Migrate(ctx); err != nil {
+		log.Fatal().Err(err).Msg("could not migrate database schema")
+	}
+}
+
+// refreshMetadata saves the series metadata of each asset when enabled
+func refreshMetadata(ctx context.Context, sources fred.Sources, assets []*fred.Asset) {
+	if !viper.GetBool("metadata.refresh") || viper.GetString("database.url") == "" || ctx.Err() != nil {
+		return
+	}
+
+	if err := fred.RefreshMetadata(ctx, sources, assets); err != nil {
+		log.Error().Err(err).Msg("failed to refresh series metadata")
+	}
+}
+
+// checkVintages exits before any work starts when --vintages is set but
+// the sources cannot download vintages
+func checkVintages(sources fred.Sources) {
+	if err := fred.CheckVintages(sources); err != nil {
+		log.Fatal().Err(err).Msg("--vintages cannot be used with the configured sources")
+	}
+}
+
+// computeDerived recomputes the configured derived series from the
+// freshly imported values of the assets handled by sources
+func computeDerived(ctx context.Context, sources fred.Sources) {
+	if viper.GetString("database.url") == "" || ctx.Err() != nil {
+		return
+	}
+
+	derived, err := fred.DerivedSeriesFromConfig()
+	if err != nil {
+		log.Error().Err(err).Msg("invalid derived series configuration")
+		return
+	}
+	if len(derived) == 0 {
+		return
+	}
+
+	if err = fred.ComputeDerived(ctx, derived, sources.AssetTypes()); err != nil {
+		log.Error().Err(err).Msg("failed to compute derived series")
+	}
+}
+
+// openSink opens each configured output. Quotes are streamed to the
+// sinks while assets are downloaded.
+func openSink(ctx context.Context) fred.Sink {
+	sinks := make(fred.MultiSink, 0, 2)
+
+	if fn := outputSetting("output_file", "parquet_file"); fn != "" {
+		sink, err := fred.NewFileSink(ctx, fn, viper.GetString("output_format"))
+		if err != nil {
+			log.Fatal().Err(err).Msg("could not create output file")
 		}
-	},
+		sinks = append(sinks, sink)
+	}
+
+	if dir := outputSetting("output_dir", "parquet_dir"); dir != "" {
+		sink, err := fred.NewPartitionedSink(ctx, dir, viper.GetString("output_format"), viper.GetStringSlice("partition_by"), viper.GetString("manifest_file"))
+		if err != nil {
+			log.Fatal().Err(err).Msg("could not create partitioned output")
+		}
+		sinks = append(sinks, sink)
+	}
+
+	if viper.GetString("database.url") != "" {
+		sink, err := fred.NewDatabaseSink(ctx)
+		if err != nil {
+			log.Fatal().Err(err).Msg("could not open database")
+		}
+		sinks = append(sinks, sink)
+	}
+
+	return sinks
+}
+
+// outputSetting returns the value of key, falling back to the deprecated
+// key it replaces
+func outputSetting(key, deprecated string) string {
+	if value := viper.GetString(key); value != "" {
+		return value
+	}
+	return viper.GetString(deprecated)
+}
+
+// closeSink flushes the outputs. Quotes that were downloaded before the
+// run was stopped are still saved.
+func closeSink(ctx context.Context, sink fred.Sink) {
+	if err := sink.Close(context.WithoutCancel(ctx)); err != nil {
+		log.Error().Err(err).Msg("failed to close output")
+	}
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
+//
+// The first SIGINT or SIGTERM stops the run after the asset in progress;
+// a second signal terminates immediately.
 func Execute() {
-	err := rootCmd.Execute()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		log.Warn().Str("Signal", sig.String()).Msg("stopping after the current asset; signal again to exit immediately")
+		signal.Stop(sigs)
+		cancel()
+	}()
+
+	runID := fred.NewRunID()
+	log.Logger = log.With().Str("RunID", runID).Logger()
+
+	err := rootCmd.ExecuteContext(fred.WithRunID(ctx, runID))
 	if err != nil {
 		os.Exit(1)
 	}
@@ -88,23 +264,44 @@ func init() {
 		log.Fatal().Err(err).Msg("could not bind pflag for log.json")
 	}
 
-	// Local flags
-	rootCmd.Flags().StringP("database-url", "d", "host=localhost port=5432", "DSN for database connection")
-	err = viper.BindPFlag("database.url", rootCmd.Flags().Lookup("database-url"))
+	rootCmd.PersistentFlags().StringP("database-url", "d", "host=localhost port=5432", "DSN for database connection")
+	err = viper.BindPFlag("database.url", rootCmd.PersistentFlags().Lookup("database-url"))
 	if err != nil {
 		log.Fatal().Err(err).Msg("could not bind pflag for database.url")
 	}
 
+	rootCmd.PersistentFlags().String("fred-api-key", "", "api key for api.stlouisfed.org")
+	err = viper.BindPFlag("fred.api_key", rootCmd.PersistentFlags().Lookup("fred-api-key"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not bind pflag for fred.api_key")
+	}
+
+	rootCmd.PersistentFlags().String("fred-endpoint", fred.EndpointAuto, "fred endpoint to download from (auto, api, graph)")
+	err = viper.BindPFlag("fred.endpoint", rootCmd.PersistentFlags().Lookup("fred-endpoint"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not bind pflag for fred.endpoint")
+	}
+
+	rootCmd.PersistentFlags().StringSlice("sources", []string{fred.SourceFRED}, "sources to download from")
+	err = viper.BindPFlag("sources", rootCmd.PersistentFlags().Lookup("sources"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not bind pflag for sources")
+	}
+
+	// Local flags
+	rootCmd.Flags().AddFlagSet(downloadFlags)
+	rootCmd.Flags().AddFlagSet(outputFlags)
+
 	rootCmd.Flags().Uint32P("limit", "l", 0, "limit results to N")
 	err = viper.BindPFlag("limit", rootCmd.Flags().Lookup("limit"))
 	if err != nil {
 		log.Fatal().Err(err).Msg("could not bind pflag for limit")
 	}
 
-	rootCmd.Flags().Int("fred-rate-limit", 5, "fred rate limit (items per second)")
-	err = viper.BindPFlag("fred_rate_limit", rootCmd.Flags().Lookup("fred-rate-limit"))
+	rootCmd.Flags().Duration("fetch-overlap", time.Duration(time.Hour*24*7), "re-download observations this far before the last stored observation to pick up revisions")
+	err = viper.BindPFlag("fetch_overlap", rootCmd.Flags().Lookup("fetch-overlap"))
 	if err != nil {
-		log.Fatal().Err(err).Msg("could not bind pflag for fred_rate_limit")
+		log.Fatal().Err(err).Msg("could not bind pflag for fetch_overlap")
 	}
 
 	rootCmd.Flags().Duration("max-age-forward-fill", time.Duration(time.Hour*24*90), "maximum age of eod values to calculate forwrad fill for")
@@ -112,12 +309,143 @@ func init() {
 	if err != nil {
 		log.Fatal().Err(err).Msg("could not bind pflag for max_age_forward_fill")
 	}
+}
+
+// downloadFlags are the options of runs that download observations. They
+// are shared by the root command and backfill only.
+var downloadFlags = newDownloadFlags()
+
+func newDownloadFlags() *pflag.FlagSet {
+	flags := pflag.NewFlagSet("download", pflag.ExitOnError)
+
+	flags.Int("fred-rate-limit", 5, "fred rate limit (items per second)")
+	err := viper.BindPFlag("fred_rate_limit", flags.Lookup("fred-rate-limit"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not bind pflag for fred_rate_limit")
+	}
+
+	flags.Int("workers", 4, "number of assets to download concurrently")
+	err = viper.BindPFlag("workers", flags.Lookup("workers"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not bind pflag for workers")
+	}
+
+	flags.Int("max-retries", 3, "number of times to retry a failed request")
+	err = viper.BindPFlag("retry.max_retries", flags.Lookup("max-retries"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not bind pflag for retry.max_retries")
+	}
+
+	flags.Duration("retry-initial-backoff", time.Second, "delay before the first retry; doubles with each retry")
+	err = viper.BindPFlag("retry.initial_backoff", flags.Lookup("retry-initial-backoff"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not bind pflag for retry.initial_backoff")
+	}
+
+	flags.Duration("retry-max-backoff", 30*time.Second, "maximum delay between retries")
+	err = viper.BindPFlag("retry.max_backoff", flags.Lookup("retry-max-backoff"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not bind pflag for retry.max_backoff")
+	}
+
+	flags.String("fill-strategy", fred.FillForward, "default strategy for missing trading days (forward, linear, none); override per series with fill.series.<ticker>")
+	err = viper.BindPFlag("fill.strategy", flags.Lookup("fill-strategy"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not bind pflag for fill.strategy")
+	}
+
+	flags.Int("fill-max-stale-days", 0, "stop filling a series after this many trading days without an observation (0 = unlimited)")
+	err = viper.BindPFlag("fill.max_stale_days", flags.Lookup("fill-max-stale-days"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not bind pflag for fill.max_stale_days")
+	}
+
+	flags.String("frequency", fred.FrequencyNative, "default observation frequency as period[:aggregation], e.g. monthly:eop (periods: native, daily, weekly, biweekly, monthly, quarterly, semiannual, annual; aggregation: avg, sum, eop); override per series with frequency.series.<ticker>")
+	err = viper.BindPFlag("frequency.default", flags.Lookup("frequency"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not bind pflag for frequency.default")
+	}
+
+	flags.Bool("refresh-metadata", true, "save series metadata (title, units, frequency, ...) to the series_metadata table")
+	err = viper.BindPFlag("metadata.refresh", flags.Lookup("refresh-metadata"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not bind pflag for metadata.refresh")
+	}
 
-	rootCmd.Flags().String("parquet-file", "", "save results to parquet")
-	err = viper.BindPFlag("parquet_file", rootCmd.Flags().Lookup("parquet-file"))
+	flags.Bool("vintages", false, "download every ALFRED real-time period and store it in eod_vintage (requires a fred api key)")
+	err = viper.BindPFlag("vintage.enabled", flags.Lookup("vintages"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not bind pflag for vintage.enabled")
+	}
+
+	flags.String("output-file", "", "save results to a file, which may be an s3://bucket/key url; the format is taken from --output-format or the file extension")
+	err = viper.BindPFlag("output_file", flags.Lookup("output-file"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not bind pflag for output_file")
+	}
+
+	flags.String("output-dir", "", "save results to a Hive-partitioned directory with a per-run manifest; the format is taken from --output-format")
+	err = viper.BindPFlag("output_dir", flags.Lookup("output-dir"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not bind pflag for output_dir")
+	}
+
+	// --parquet-file and --parquet-dir predate the other output formats
+	flags.String("parquet-file", "", "save results to a file")
+	err = viper.BindPFlag("parquet_file", flags.Lookup("parquet-file"))
 	if err != nil {
 		log.Fatal().Err(err).Msg("could not bind pflag for parquet_file")
 	}
+	err = flags.MarkDeprecated("parquet-file", "use --output-file instead")
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not deprecate parquet-file")
+	}
+
+	flags.String("parquet-dir", "", "save results to a Hive-partitioned directory")
+	err = viper.BindPFlag("parquet_dir", flags.Lookup("parquet-dir"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not bind pflag for parquet_dir")
+	}
+	err = flags.MarkDeprecated("parquet-dir", "use --output-dir instead")
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not deprecate parquet-dir")
+	}
+
+	flags.String("output-format", "", "format of --output-file and --output-dir output (parquet, csv, ndjson, arrow); by default chosen by file extension, falling back to parquet")
+	err = viper.BindPFlag("output_format", flags.Lookup("output-format"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not bind pflag for output_format")
+	}
+
+	return flags
+}
+
+// outputFlags configure where files are written. They are shared by the
+// commands that write files: the root command, backfill and export.
+var outputFlags = newOutputFlags()
+
+func newOutputFlags() *pflag.FlagSet {
+	flags := pflag.NewFlagSet("output", pflag.ExitOnError)
+
+	flags.String("s3-endpoint", fred.DefaultS3Endpoint, "S3-compatible endpoint for s3:// outputs, e.g. s3.us-west-004.backblazeb2.com; credentials are read from s3.access_key_id and s3.secret_access_key or the AWS environment")
+	err := viper.BindPFlag("s3.endpoint", flags.Lookup("s3-endpoint"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not bind pflag for s3.endpoint")
+	}
+
+	flags.StringSlice("partition-by", fred.DefaultPartitionBy, "partition keys for --output-dir (ticker, composite_figi, asset_type, exchange, frequency, year, month)")
+	err = viper.BindPFlag("partition_by", flags.Lookup("partition-by"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not bind pflag for partition_by")
+	}
+
+	flags.String("manifest", "", "path of the run manifest written with --output-dir (default <output-dir>/manifest-<run id>.json)")
+	err = viper.BindPFlag("manifest_file", flags.Lookup("manifest"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not bind pflag for manifest_file")
+	}
+
+	return flags
 }
 
 func initLog() {
@@ -144,6 +472,7 @@ func initConfig() {
 		viper.SetConfigName("import-fred")
 	}
 
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 	viper.AutomaticEnv() // read in environment variables that match
 
 	// If a config file is found, read it in.
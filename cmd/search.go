@@ -0,0 +1,113 @@
+// Copyright 2022
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/penny-vault/import-fred/fred"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	rootCmd.AddCommand(searchCmd)
+
+	searchCmd.Flags().String("source", fred.SourceFRED, "source to search")
+	err := viper.BindPFlag("search.source", searchCmd.Flags().Lookup("source"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not bind pflag for search.source")
+	}
+
+	searchCmd.Flags().String("frequency", "", "only return series with this native frequency (e.g. daily, weekly, monthly)")
+	err = viper.BindPFlag("search.frequency", searchCmd.Flags().Lookup("frequency"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not bind pflag for search.frequency")
+	}
+
+	searchCmd.Flags().Int("limit", 20, "maximum number of series to return")
+	err = viper.BindPFlag("search.limit", searchCmd.Flags().Lookup("limit"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not bind pflag for search.limit")
+	}
+
+	searchCmd.Flags().Bool("json", false, "print results as json")
+	err = viper.BindPFlag("search.json", searchCmd.Flags().Lookup("json"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not bind pflag for search.json")
+	}
+}
+
+var searchCmd = &cobra.Command{
+	Use:   "search [text]",
+	Short: "Search for series by keyword",
+	Long: `Search the series published by a source by keyword. Results are
+ordered by popularity. Searching FRED requires an api key.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		src, err := fred.NewSource(viper.GetString("search.source"))
+		if err != nil {
+			log.Fatal().Err(err).Msg("could not create source")
+		}
+
+		series, err := src.ListSeries(cmd.Context(), fred.SeriesFilter{
+			Query:     strings.Join(args, " "),
+			Frequency: viper.GetString("search.frequency"),
+			Limit:     viper.GetInt("search.limit"),
+		})
+		if err != nil {
+			log.Fatal().Err(err).Msg("search failed")
+		}
+
+		if viper.GetBool("search.json") {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(series); err != nil {
+				log.Fatal().Err(err).Msg("could not encode results")
+			}
+			return
+		}
+
+		printSeriesTable(series)
+	},
+}
+
+// printSeriesTable renders series as an aligned table on stdout
+func printSeriesTable(series []*fred.Series) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTITLE\tUNITS\tFREQUENCY\tPOPULARITY\tOBSERVATIONS")
+	for _, s := range series {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s - %s\n",
+			s.ID, truncate(s.Title, 60), truncate(s.UnitsShort, 24), s.Frequency, s.Popularity,
+			s.ObservationStart.Format("2006-01-02"), s.ObservationEnd.Format("2006-01-02"))
+	}
+	if err := w.Flush(); err != nil {
+		log.Error().Err(err).Msg("could not write search results")
+	}
+}
+
+// truncate shortens s to at most n runes
+func truncate(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n-3]) + "..."
+}
@@ -0,0 +1,305 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fred
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	DefaultAPIBaseURL = "https://api.stlouisfed.org/fred"
+
+	// maximum number of observations FRED returns per request
+	apiPageLimit = 100000
+
+	// maximum number of series FRED returns per search request
+	apiSearchPageLimit = 1000
+)
+
+// APIClient uses the documented FRED web service at api.stlouisfed.org
+type APIClient struct {
+	BaseURL string
+	APIKey  string
+
+	client *resty.Client
+}
+
+type apiObservation struct {
+	RealtimeStart string `json:"realtime_start"`
+	RealtimeEnd   string `json:"realtime_end"`
+	Date          string `json:"date"`
+	Value         string `json:"value"`
+}
+
+type apiObservationsResponse struct {
+	Count        int              `json:"count"`
+	Offset       int              `json:"offset"`
+	Limit        int              `json:"limit"`
+	Observations []apiObservation `json:"observations"`
+}
+
+func NewAPIClient(apiKey string) *APIClient {
+	return &APIClient{
+		BaseURL: DefaultAPIBaseURL,
+		APIKey:  apiKey,
+		client:  resty.New(),
+	}
+}
+
+// get requests the given FRED API path and decodes the JSON response into
+// result. Errors reported by FRED are returned as *APIError.
+func (c *APIClient) get(ctx context.Context, path string, params map[string]string, result interface{}) error {
+	apiErr := &APIError{}
+	resp, err := c.client.R().
+		SetContext(ctx).
+		SetHeader("Accept", "application/json").
+		ForceContentType("application/json").
+		SetQueryParams(params).
+		SetQueryParam("api_key", c.APIKey).
+		SetQueryParam("file_type", "json").
+		SetResult(result).
+		SetError(apiErr).
+		Get(c.BaseURL + path)
+	if err != nil {
+		return err
+	}
+
+	if resp.IsError() {
+		apiErr.StatusCode = resp.StatusCode()
+		apiErr.RetryAfter = parseRetryAfter(resp.Header().Get("Retry-After"))
+		if apiErr.Code == 0 {
+			apiErr.Code = resp.StatusCode()
+			apiErr.Message = string(resp.Body())
+		}
+		return apiErr
+	}
+
+	return nil
+}
+
+// Observations pages through fred/series/observations for the given series
+func (c *APIClient) Observations(ctx context.Context, seriesID string, start, end time.Time, freq Frequency) ([]*Observation, error) {
+	return c.observations(ctx, seriesID, start, end, freq, map[string]string{})
+}
+
+// Vintages returns every real-time period (ALFRED vintage) of the
+// observations between start and end. Each observation carries the
+// RealtimeStart and RealtimeEnd of the period in which its value was
+// current.
+func (c *APIClient) Vintages(ctx context.Context, seriesID string, start, end time.Time, freq Frequency) ([]*Observation, error) {
+	return c.observations(ctx, seriesID, start, end, freq, map[string]string{
+		"realtime_start": FullHistoryStart.Format("2006-01-02"),
+		"realtime_end":   RealtimeOpenEnd.Format("2006-01-02"),
+	})
+}
+
+func (c *APIClient) observations(ctx context.Context, seriesID string, start, end time.Time, freq Frequency, params map[string]string) ([]*Observation, error) {
+	observations := make([]*Observation, 0)
+	offset := 0
+
+	id, units, err := SplitTicker(seriesID)
+	if err != nil {
+		return nil, err
+	}
+
+	params["series_id"] = id
+	params["observation_start"] = start.Format("2006-01-02")
+	params["observation_end"] = end.Format("2006-01-02")
+	params["sort_order"] = "asc"
+	params["limit"] = strconv.Itoa(apiPageLimit)
+
+	if units != "" {
+		params["units"] = units
+	}
+
+	if !freq.IsNative() {
+		params["frequency"] = strings.ToLower(frequencyShort[freq.Period])
+		params["aggregation_method"] = freq.Aggregation
+	}
+
+	for {
+		params["offset"] = strconv.Itoa(offset)
+
+		result := &apiObservationsResponse{}
+		err := c.get(ctx, "/series/observations", params, result)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, obs := range result.Observations {
+			if obs.Value == "." {
+				continue
+			}
+
+			dt, err := time.Parse("2006-01-02", obs.Date)
+			if err != nil {
+				log.Warn().Str("Ticker", seriesID).Str("Date", obs.Date).Err(err).Msg("could not parse observation date")
+				continue
+			}
+
+			val, err := strconv.ParseFloat(obs.Value, 64)
+			if err != nil {
+				log.Warn().Str("Ticker", seriesID).Str("Val", obs.Value).Err(err).Msg("could not convert str to float")
+				continue
+			}
+
+			observation := &Observation{Date: dt, Value: val}
+			if _, ok := params["realtime_start"]; ok {
+				if observation.RealtimeStart, err = time.Parse("2006-01-02", obs.RealtimeStart); err != nil {
+					log.Warn().Str("Ticker", seriesID).Str("RealtimeStart", obs.RealtimeStart).Err(err).Msg("could not parse realtime start")
+					continue
+				}
+				if observation.RealtimeEnd, err = time.Parse("2006-01-02", obs.RealtimeEnd); err != nil {
+					log.Warn().Str("Ticker", seriesID).Str("RealtimeEnd", obs.RealtimeEnd).Err(err).Msg("could not parse realtime end")
+					continue
+				}
+			}
+
+			observations = append(observations, observation)
+		}
+
+		offset += len(result.Observations)
+		if len(result.Observations) == 0 || offset >= result.Count {
+			break
+		}
+	}
+
+	return observations, nil
+}
+
+type apiSeries struct {
+	ID                      string `json:"id"`
+	Title                   string `json:"title"`
+	ObservationStart        string `json:"observation_start"`
+	ObservationEnd          string `json:"observation_end"`
+	Frequency               string `json:"frequency"`
+	FrequencyShort          string `json:"frequency_short"`
+	Units                   string `json:"units"`
+	UnitsShort              string `json:"units_short"`
+	SeasonalAdjustment      string `json:"seasonal_adjustment"`
+	SeasonalAdjustmentShort string `json:"seasonal_adjustment_short"`
+	LastUpdated             string `json:"last_updated"`
+	Popularity              int    `json:"popularity"`
+	Notes                   string `json:"notes"`
+}
+
+type apiSeriesResponse struct {
+	Count  int          `json:"count"`
+	Offset int          `json:"offset"`
+	Limit  int          `json:"limit"`
+	Series []*apiSeries `json:"seriess"`
+}
+
+func (s *apiSeries) toSeries() *Series {
+	series := &Series{
+		ID:                      s.ID,
+		Title:                   s.Title,
+		Units:                   s.Units,
+		UnitsShort:              s.UnitsShort,
+		Frequency:               s.Frequency,
+		FrequencyShort:          s.FrequencyShort,
+		SeasonalAdjustment:      s.SeasonalAdjustment,
+		SeasonalAdjustmentShort: s.SeasonalAdjustmentShort,
+		Popularity:              s.Popularity,
+		Notes:                   s.Notes,
+	}
+
+	var err error
+	if series.ObservationStart, err = time.Parse("2006-01-02", s.ObservationStart); err != nil {
+		log.Warn().Str("Ticker", s.ID).Str("ObservationStart", s.ObservationStart).Err(err).Msg("could not parse observation start")
+	}
+	if series.ObservationEnd, err = time.Parse("2006-01-02", s.ObservationEnd); err != nil {
+		log.Warn().Str("Ticker", s.ID).Str("ObservationEnd", s.ObservationEnd).Err(err).Msg("could not parse observation end")
+	}
+	// FRED reports last_updated with an hour-only utc offset, e.g. 2013-07-31 09:26:16-05
+	if series.LastUpdated, err = time.Parse("2006-01-02 15:04:05-07", s.LastUpdated); err != nil {
+		log.Warn().Str("Ticker", s.ID).Str("LastUpdated", s.LastUpdated).Err(err).Msg("could not parse last updated")
+	}
+
+	return series
+}
+
+// Series returns metadata for the given series from fred/series
+func (c *APIClient) Series(ctx context.Context, seriesID string) (*Series, error) {
+	result := &apiSeriesResponse{}
+	err := c.get(ctx, "/series", map[string]string{
+		"series_id": seriesID,
+	}, result)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(result.Series) == 0 {
+		return nil, &APIError{Code: 404, Message: "series not found: " + seriesID}
+	}
+
+	return result.Series[0].toSeries(), nil
+}
+
+// Search returns series matching the filter from fred/series/search
+// ordered by popularity. Results are requested a page at a time until
+// filter.Limit series have been returned; without a limit a single page
+// is returned.
+func (c *APIClient) Search(ctx context.Context, filter SeriesFilter) ([]*Series, error) {
+	params := map[string]string{
+		"search_text": filter.Query,
+		"order_by":    "popularity",
+		"sort_order":  "desc",
+	}
+
+	if filter.Frequency != "" {
+		// FRED expects the capitalized frequency name, e.g. Daily
+		freq := strings.ToLower(filter.Frequency)
+		params["filter_variable"] = "frequency"
+		params["filter_value"] = strings.ToUpper(freq[:1]) + freq[1:]
+	}
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = apiSearchPageLimit
+	}
+
+	series := make([]*Series, 0, limit)
+	for len(series) < limit {
+		pageSize := limit - len(series)
+		if pageSize > apiSearchPageLimit {
+			pageSize = apiSearchPageLimit
+		}
+		params["limit"] = strconv.Itoa(pageSize)
+		params["offset"] = strconv.Itoa(len(series))
+
+		result := &apiSeriesResponse{}
+		if err := c.get(ctx, "/series/search", params, result); err != nil {
+			return nil, err
+		}
+
+		for _, s := range result.Series {
+			series = append(series, s.toSeries())
+		}
+
+		if len(result.Series) == 0 || len(series) >= result.Count {
+			break
+		}
+	}
+
+	return series, nil
+}
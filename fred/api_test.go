@@ -0,0 +1,297 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fred
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestAPIClient(t *testing.T, handler http.HandlerFunc) *APIClient {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	client := NewAPIClient("test-key")
+	client.BaseURL = srv.URL
+	return client
+}
+
+func TestAPIClientObservationsPaginates(t *testing.T) {
+	pages := map[string][]apiObservation{
+		"0": {
+			{Date: "2024-01-02", Value: "4.1"},
+			{Date: "2024-01-03", Value: "."},
+		},
+		"2": {
+			{Date: "2024-01-04", Value: "4.3"},
+		},
+	}
+
+	var offsets []string
+	client := newTestAPIClient(t, func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if r.URL.Path != "/series/observations" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if got := query.Get("api_key"); got != "test-key" {
+			t.Errorf("api_key = %q", got)
+		}
+		if got := query.Get("series_id"); got != "DGS10" {
+			t.Errorf("series_id = %q", got)
+		}
+		if got := query.Get("units"); got != "pc1" {
+			t.Errorf("units = %q", got)
+		}
+		if got := query.Get("frequency"); got != "m" {
+			t.Errorf("frequency = %q", got)
+		}
+		if got := query.Get("aggregation_method"); got != AggregationEndOfPeriod {
+			t.Errorf("aggregation_method = %q", got)
+		}
+
+		offset := query.Get("offset")
+		offsets = append(offsets, offset)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(apiObservationsResponse{Count: 3, Observations: pages[offset]})
+	})
+
+	freq := Frequency{Period: FrequencyMonthly, Aggregation: AggregationEndOfPeriod}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	observations, err := client.Observations(context.Background(), "DGS10:pc1", start, start.AddDate(0, 1, 0), freq)
+	if err != nil {
+		t.Fatalf("Observations() error = %v", err)
+	}
+
+	if len(offsets) != 2 || offsets[0] != "0" || offsets[1] != "2" {
+		t.Errorf("requested offsets %v, want [0 2]", offsets)
+	}
+
+	want := []struct {
+		date  string
+		value float64
+	}{
+		{"2024-01-02", 4.1},
+		{"2024-01-04", 4.3},
+	}
+	if len(observations) != len(want) {
+		t.Fatalf("got %d observations, want %d", len(observations), len(want))
+	}
+	for idx, obs := range observations {
+		if obs.Date.Format("2006-01-02") != want[idx].date || obs.Value != want[idx].value {
+			t.Errorf("observation %d = %s %v, want %s %v", idx, obs.Date.Format("2006-01-02"), obs.Value, want[idx].date, want[idx].value)
+		}
+	}
+}
+
+func TestAPIClientObservationsError(t *testing.T) {
+	client := newTestAPIClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusTooManyRequests)
+		_, _ = w.Write([]byte(`{"error_code":429,"error_message":"Too Many Requests.  Exceeded Rate Limit"}`))
+	})
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	_, err := client.Observations(context.Background(), "DGS10", start, start, NativeFrequency)
+
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("Observations() error = %v, want *APIError", err)
+	}
+	if apiErr.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("StatusCode = %d", apiErr.StatusCode)
+	}
+	if apiErr.Code != 429 {
+		t.Errorf("Code = %d", apiErr.Code)
+	}
+	if apiErr.Message != "Too Many Requests.  Exceeded Rate Limit" {
+		t.Errorf("Message = %q", apiErr.Message)
+	}
+	if apiErr.RetryAfter != 30*time.Second {
+		t.Errorf("RetryAfter = %v", apiErr.RetryAfter)
+	}
+}
+
+func TestAPIClientSeries(t *testing.T) {
+	client := newTestAPIClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/series" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if got := r.URL.Query().Get("series_id"); got != "UNRATE" {
+			t.Errorf("series_id = %q", got)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"seriess":[{
+			"id":"UNRATE",
+			"title":"Unemployment Rate",
+			"observation_start":"1948-01-01",
+			"observation_end":"2024-02-01",
+			"frequency":"Monthly",
+			"frequency_short":"M",
+			"units":"Percent",
+			"units_short":"%",
+			"seasonal_adjustment":"Seasonally Adjusted",
+			"seasonal_adjustment_short":"SA",
+			"last_updated":"2024-03-08 07:45:02-05",
+			"popularity":94
+		}]}`))
+	})
+
+	series, err := client.Series(context.Background(), "UNRATE")
+	if err != nil {
+		t.Fatalf("Series() error = %v", err)
+	}
+
+	if series.ID != "UNRATE" || series.Units != "Percent" || series.Frequency != "Monthly" || series.SeasonalAdjustmentShort != "SA" {
+		t.Errorf("Series() = %+v", series)
+	}
+	if want := time.Date(1948, 1, 1, 0, 0, 0, 0, time.UTC); !series.ObservationStart.Equal(want) {
+		t.Errorf("ObservationStart = %s, want %s", series.ObservationStart, want)
+	}
+	if want := time.Date(2024, 3, 8, 12, 45, 2, 0, time.UTC); !series.LastUpdated.Equal(want) {
+		t.Errorf("LastUpdated = %s, want %s", series.LastUpdated, want)
+	}
+}
+
+func TestAPIClientSeriesNotFound(t *testing.T) {
+	client := newTestAPIClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"seriess":[]}`))
+	})
+
+	_, err := client.Series(context.Background(), "MISSING")
+
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Code != 404 {
+		t.Errorf("Series() error = %v, want a 404 *APIError", err)
+	}
+}
+
+func TestAPIClientSearchFrequency(t *testing.T) {
+	tests := []struct {
+		frequency string
+		want      string
+	}{
+		{"", ""},
+		{"daily", "Daily"},
+		{"MONTHLY", "Monthly"},
+		{"Quarterly", "Quarterly"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.frequency, func(t *testing.T) {
+			client := newTestAPIClient(t, func(w http.ResponseWriter, r *http.Request) {
+				query := r.URL.Query()
+				if r.URL.Path != "/series/search" {
+					t.Errorf("unexpected path %s", r.URL.Path)
+				}
+				if got := query.Get("search_text"); got != "10-year treasury" {
+					t.Errorf("search_text = %q", got)
+				}
+				if got := query.Get("filter_value"); got != tt.want {
+					t.Errorf("filter_value = %q, want %q", got, tt.want)
+				}
+				wantVariable := ""
+				if tt.want != "" {
+					wantVariable = "frequency"
+				}
+				if got := query.Get("filter_variable"); got != wantVariable {
+					t.Errorf("filter_variable = %q, want %q", got, wantVariable)
+				}
+				w.Header().Set("Content-Type", "application/json")
+				_ = json.NewEncoder(w).Encode(apiSeriesResponse{Count: 1, Series: []*apiSeries{{ID: "DGS10"}}})
+			})
+
+			series, err := client.Search(context.Background(), SeriesFilter{Query: "10-year treasury", Frequency: tt.frequency, Limit: 20})
+			if err != nil {
+				t.Fatalf("Search() error = %v", err)
+			}
+			if len(series) != 1 || series[0].ID != "DGS10" {
+				t.Errorf("Search() returned %d series", len(series))
+			}
+		})
+	}
+}
+
+func TestAPIClientSearchPaginates(t *testing.T) {
+	page := func(offset, size int) []*apiSeries {
+		series := make([]*apiSeries, size)
+		for idx := range series {
+			series[idx] = &apiSeries{ID: strconv.Itoa(offset + idx)}
+		}
+		return series
+	}
+
+	tests := []struct {
+		name    string
+		limit   int
+		count   int
+		want    int
+		offsets []string
+		limits  []string
+	}{
+		{"single page", 20, 5000, 20, []string{"0"}, []string{"20"}},
+		{"default limit", 0, 5000, 1000, []string{"0"}, []string{"1000"}},
+		{"several pages", 2500, 5000, 2500, []string{"0", "1000", "2000"}, []string{"1000", "1000", "500"}},
+		{"fewer results than limit", 2500, 1200, 1200, []string{"0", "1000"}, []string{"1000", "1000"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var offsets, limits []string
+			client := newTestAPIClient(t, func(w http.ResponseWriter, r *http.Request) {
+				query := r.URL.Query()
+				offsets = append(offsets, query.Get("offset"))
+				limits = append(limits, query.Get("limit"))
+
+				offset, _ := strconv.Atoi(query.Get("offset"))
+				size, _ := strconv.Atoi(query.Get("limit"))
+				if offset+size > tt.count {
+					size = tt.count - offset
+				}
+				w.Header().Set("Content-Type", "application/json")
+				_ = json.NewEncoder(w).Encode(apiSeriesResponse{Count: tt.count, Offset: offset, Series: page(offset, size)})
+			})
+
+			series, err := client.Search(context.Background(), SeriesFilter{Query: "rate", Limit: tt.limit})
+			if err != nil {
+				t.Fatalf("Search() error = %v", err)
+			}
+			if len(series) != tt.want {
+				t.Fatalf("Search() returned %d series, want %d", len(series), tt.want)
+			}
+			for idx, s := range series {
+				if s.ID != strconv.Itoa(idx) {
+					t.Fatalf("series %d = %s, want results in order", idx, s.ID)
+				}
+			}
+			if strings.Join(offsets, ",") != strings.Join(tt.offsets, ",") {
+				t.Errorf("requested offsets %v, want %v", offsets, tt.offsets)
+			}
+			if strings.Join(limits, ",") != strings.Join(tt.limits, ",") {
+				t.Errorf("requested limits %v, want %v", limits, tt.limits)
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fred
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+var (
+	ErrSeriesNotFound = errors.New("series not found")
+	ErrDuplicateAsset = errors.New("ticker is registered under more than one composite figi")
+)
+
+// figiAlphabet is the set of characters allowed in positions 4-11 of a
+// FIGI: digits and upper-case consonants
+const figiAlphabet = "0123456789BCDFGHJKLMNPQRSTVWXYZ"
+
+// syntheticFigiPrefix marks identifiers generated by penny vault; real
+// FIGIs issued by Bloomberg start with BBG
+const syntheticFigiPrefix = "PVG"
+
+// SyntheticFigi returns the deterministic composite figi used for a series
+// that has no real FIGI. The identifier is derived from the asset type and
+// ticker, is formatted like a FIGI (including a valid check digit) and
+// always starts with PVG.
+func SyntheticFigi(assetType, ticker string) string {
+	sum := sha256.Sum256([]byte(strings.ToUpper(assetType) + ":" + strings.ToUpper(ticker)))
+	num := new(big.Int).SetBytes(sum[:])
+	base := big.NewInt(int64(len(figiAlphabet)))
+
+	var sb strings.Builder
+	sb.WriteString(syntheticFigiPrefix)
+	mod := new(big.Int)
+	for idx := 0; idx < 8; idx++ {
+		num.DivMod(num, base, mod)
+		sb.WriteByte(figiAlphabet[mod.Int64()])
+	}
+
+	figi := sb.String()
+	return figi + string(rune('0'+figiCheckDigit(figi)))
+}
+
+// figiCheckDigit computes the check digit of the first 11 characters of a
+// FIGI. Letters are converted to numbers (A=10 ... Z=35), every second
+// number is doubled and the digits of the results are summed.
+func figiCheckDigit(figi string) int {
+	sum := 0
+	for idx, ch := range figi {
+		var val int
+		if ch >= '0' && ch <= '9' {
+			val = int(ch - '0')
+		} else {
+			val = int(ch-'A') + 10
+		}
+
+		if idx%2 == 1 {
+			val *= 2
+		}
+
+		for val > 0 {
+			sum += val % 10
+			val /= 10
+		}
+	}
+	return (10 - sum%10) % 10
+}
+
+// validationYears is the number of years of observations downloaded to
+// confirm that a series exists when its source cannot describe it
+const validationYears = 5
+
+// validateSeries confirms that the source publishes the series and returns
+// its description. Sources that cannot describe series are checked by
+// downloading the series' recent observations instead; the returned
+// description is then nil.
+func validateSeries(ctx context.Context, src Source, ticker string) (*Series, error) {
+	series, err := src.DescribeSeries(ctx, ticker)
+	if err == nil {
+		return series, nil
+	}
+
+	if !errors.Is(err, ErrMissingAPIKey) && !errors.Is(err, ErrNotSupported) {
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && (apiErr.Code == 400 || apiErr.Code == 404) {
+			return nil, fmt.Errorf("%w: %s: %s", ErrSeriesNotFound, ticker, apiErr.Message)
+		}
+		return nil, err
+	}
+
+	now := time.Now()
+	observations, err := src.Observations(ctx, ticker, now.AddDate(-validationYears, 0, 0), now, NativeFrequency)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %s", ErrSeriesNotFound, ticker, err.Error())
+	}
+	if len(observations) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrSeriesNotFound, ticker)
+	}
+	return nil, nil
+}
+
+// AddSeries validates each ticker against the source and registers it as
+// an active asset in the assets table. Tickers that already exist are
+// re-activated. It returns the registered assets; tickers that failed are
+// logged and skipped, and the last failure is returned as the error.
+func AddSeries(ctx context.Context, src Source, tickers []string) ([]*Asset, error) {
+	conn, err := pgx.Connect(ctx, viper.GetString("database.url"))
+	if err != nil {
+		log.Error().Err(err).Msg("Could not connect to database")
+		return nil, err
+	}
+	defer conn.Close(ctx)
+
+	var lastErr error
+	assets := make([]*Asset, 0, len(tickers))
+	for _, name := range tickers {
+		ticker, err := CanonicalTicker(name)
+		if err != nil {
+			log.Error().Err(err).Str("Ticker", name).Msg("invalid ticker")
+			lastErr = err
+			continue
+		}
+		subLog := log.With().Str("Ticker", ticker).Logger()
+
+		series, err := validateSeries(ctx, src, ticker)
+		if err != nil {
+			subLog.Error().Err(err).Msg("could not validate series")
+			lastErr = err
+			continue
+		}
+
+		asset := &Asset{
+			CompositeFigi: SyntheticFigi(src.AssetType(), ticker),
+			Ticker:        ticker,
+			AssetType:     src.AssetType(),
+			Series:        series,
+		}
+		if series != nil {
+			asset.ObservationStart = series.ObservationStart
+		}
+
+		if err = registerAsset(ctx, conn, asset); err != nil {
+			subLog.Error().Err(err).Msg("could not register asset")
+			lastErr = err
+			continue
+		}
+
+		subLog.Info().Str("CompositeFigi", asset.CompositeFigi).Msg("registered series")
+		assets = append(assets, asset)
+	}
+
+	return assets, lastErr
+}
+
+// registerAsset activates the asset if its ticker is already registered
+// for the asset type and inserts it otherwise. An existing row is kept
+// under its composite figi, which may have been assigned by hand, so that
+// the series is never stored under two identifiers; asset.CompositeFigi is
+// updated to match it.
+func registerAsset(ctx context.Context, conn *pgx.Conn, asset *Asset) error {
+	rows, err := conn.Query(ctx, `SELECT composite_figi FROM assets WHERE ticker = $1 AND asset_type = $2`, asset.Ticker, asset.AssetType)
+	if err != nil {
+		return err
+	}
+
+	figis := make([]string, 0, 1)
+	for rows.Next() {
+		var figi string
+		if err = rows.Scan(&figi); err != nil {
+			rows.Close()
+			return err
+		}
+		figis = append(figis, figi)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	figi, insert, err := registeredFigi(asset, figis)
+	if err != nil {
+		return err
+	}
+
+	if insert {
+		_, err = conn.Exec(ctx, `INSERT INTO assets (composite_figi, ticker, asset_type, active) VALUES ($1, $2, $3, 't')`,
+			asset.CompositeFigi, asset.Ticker, asset.AssetType)
+		return err
+	}
+
+	if figi != asset.CompositeFigi {
+		log.Warn().Str("Ticker", asset.Ticker).Str("CompositeFigi", figi).Str("SyntheticFigi", asset.CompositeFigi).
+			Msg("ticker is already registered under a different composite figi; re-activating the existing asset")
+		asset.CompositeFigi = figi
+	}
+	_, err = conn.Exec(ctx, `UPDATE assets SET active = 't' WHERE composite_figi = $1 AND ticker = $2 AND asset_type = $3`,
+		asset.CompositeFigi, asset.Ticker, asset.AssetType)
+	return err
+}
+
+// registeredFigi decides how asset is registered given the composite
+// figis already registered for its ticker and asset type. It returns the
+// figi the asset is stored under and whether a new row must be inserted;
+// a ticker registered under more than one figi is an error.
+func registeredFigi(asset *Asset, figis []string) (figi string, insert bool, err error) {
+	switch len(figis) {
+	case 0:
+		return asset.CompositeFigi, true, nil
+	case 1:
+		return figis[0], false, nil
+	default:
+		return "", false, fmt.Errorf("%w: %s %s (%s); remove the incorrect rows from assets", ErrDuplicateAsset, asset.AssetType, asset.Ticker, strings.Join(figis, ", "))
+	}
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fred
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestFigiCheckDigit(t *testing.T) {
+	// check digits of FIGIs issued by Bloomberg
+	tests := []struct {
+		figi string
+		want int
+	}{
+		{"BBG000BLNNH6", 6}, // IBM
+		{"BBG000B9XRY4", 4}, // Apple
+		{"BBG000BPH459", 9}, // Microsoft
+		{"BBG009S39JX6", 6}, // Alphabet
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.figi, func(t *testing.T) {
+			if got := figiCheckDigit(tt.figi[:11]); got != tt.want {
+				t.Errorf("figiCheckDigit(%s) = %d, want %d", tt.figi[:11], got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyntheticFigi(t *testing.T) {
+	tests := []struct {
+		assetType string
+		ticker    string
+		want      string
+	}{
+		{"FRED", "DGS10", "PVG8S1RW9PY9"},
+		{"fred", "dgs10", "PVG8S1RW9PY9"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.assetType+":"+tt.ticker, func(t *testing.T) {
+			if got := SyntheticFigi(tt.assetType, tt.ticker); got != tt.want {
+				t.Errorf("SyntheticFigi(%s, %s) = %s, want %s", tt.assetType, tt.ticker, got, tt.want)
+			}
+		})
+	}
+
+	seen := make(map[string]string)
+	for _, key := range []struct{ assetType, ticker string }{
+		{"FRED", "DGS10"},
+		{"FRED", "DGS3MO"},
+		{"FRED", "CPIAUCSL:pc1"},
+		{"DERIVED", "DGS10"},
+		{"DERIVED", "SPREAD_10Y3M"},
+	} {
+		figi := SyntheticFigi(key.assetType, key.ticker)
+
+		if len(figi) != 12 || !strings.HasPrefix(figi, syntheticFigiPrefix) {
+			t.Errorf("SyntheticFigi(%s, %s) = %s, want 12 characters starting with %s", key.assetType, key.ticker, figi, syntheticFigiPrefix)
+		}
+		for _, ch := range figi[3:11] {
+			if !strings.ContainsRune(figiAlphabet, ch) {
+				t.Errorf("SyntheticFigi(%s, %s) = %s contains %q", key.assetType, key.ticker, figi, ch)
+			}
+		}
+		if want := byte('0' + figiCheckDigit(figi[:11])); figi[11] != want {
+			t.Errorf("SyntheticFigi(%s, %s) = %s, want check digit %c", key.assetType, key.ticker, figi, want)
+		}
+
+		if other, ok := seen[figi]; ok {
+			t.Errorf("SyntheticFigi(%s, %s) = %s collides with %s", key.assetType, key.ticker, figi, other)
+		}
+		seen[figi] = key.assetType + ":" + key.ticker
+	}
+}
+
+func TestRegisteredFigi(t *testing.T) {
+	synthetic := SyntheticFigi(AssetTypeFRED, "DGS10")
+
+	tests := []struct {
+		name   string
+		figis  []string
+		figi   string
+		insert bool
+		err    error
+	}{
+		{"new ticker", nil, synthetic, true, nil},
+		{"registered by add-series", []string{synthetic}, synthetic, false, nil},
+		{"registered under a hand-assigned figi", []string{"BBG000BLNNH6"}, "BBG000BLNNH6", false, nil},
+		{"registered more than once", []string{synthetic, "BBG000BLNNH6"}, "", false, ErrDuplicateAsset},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			asset := &Asset{CompositeFigi: synthetic, Ticker: "DGS10", AssetType: AssetTypeFRED}
+
+			figi, insert, err := registeredFigi(asset, tt.figis)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("registeredFigi() error = %v, want %v", err, tt.err)
+			}
+			if figi != tt.figi || insert != tt.insert {
+				t.Errorf("registeredFigi() = (%s, %v), want (%s, %v)", figi, insert, tt.figi, tt.insert)
+			}
+		})
+	}
+}
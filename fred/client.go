@@ -0,0 +1,96 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fred
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	EndpointAuto  = "auto"
+	EndpointAPI   = "api"
+	EndpointGraph = "graph"
+)
+
+var (
+	ErrMissingAPIKey   = errors.New("fred api key is required")
+	ErrUnknownEndpoint = errors.New("unknown fred endpoint")
+)
+
+// RealtimeOpenEnd is the realtime_end FRED reports for values that are
+// still current
+var RealtimeOpenEnd = time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+
+// Observation is a single dated value of a FRED series
+type Observation struct {
+	Date  time.Time
+	Value float64
+
+	// RealtimeStart and RealtimeEnd bound the period in which Value was
+	// the published value. They are only set for vintage observations.
+	RealtimeStart time.Time
+	RealtimeEnd   time.Time
+}
+
+// Client retrieves observations for a series between start and end
+// (inclusive) at the given frequency. Missing values reported by FRED as
+// "." are omitted.
+type Client interface {
+	Observations(ctx context.Context, seriesID string, start, end time.Time, freq Frequency) ([]*Observation, error)
+}
+
+// APIError is the structured error returned by the FRED API
+type APIError struct {
+	StatusCode int           `json:"-"`
+	RetryAfter time.Duration `json:"-"`
+	Code       int           `json:"error_code"`
+	Message    string        `json:"error_message"`
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("fred api error %d: %s", e.Code, e.Message)
+}
+
+// NewClientFromConfig returns the client selected by the `fred.endpoint`
+// configuration value. In auto mode the API is used when an api key is
+// configured, otherwise the fredgraph.csv export is used.
+func NewClientFromConfig() (Client, error) {
+	apiKey := viper.GetString("fred.api_key")
+	endpoint := strings.ToLower(viper.GetString("fred.endpoint"))
+
+	switch endpoint {
+	case EndpointAuto, "":
+		if apiKey != "" {
+			return NewAPIClient(apiKey), nil
+		}
+		return NewGraphClient(), nil
+	case EndpointAPI:
+		if apiKey == "" {
+			return nil, ErrMissingAPIKey
+		}
+		return NewAPIClient(apiKey), nil
+	case EndpointGraph:
+		return NewGraphClient(), nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownEndpoint, endpoint)
+	}
+}
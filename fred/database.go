@@ -17,97 +17,326 @@ package fred
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/jackc/pgx/v4"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
 )
 
-func LoadAssetsFromDB() (assets []*Asset) {
+const assetsQuery = `SELECT
+	composite_figi,
+	ticker,
+	asset_type,
+	(SELECT max(event_date) FROM eod WHERE eod.composite_figi = assets.composite_figi AND eod.source IS DISTINCT FROM 'api.pennyvault.com') AS last_date,
+	(SELECT frequency_short FROM series_metadata WHERE series_metadata.composite_figi = assets.composite_figi) AS native_frequency,
+	(SELECT observation_start FROM series_metadata WHERE series_metadata.composite_figi = assets.composite_figi) AS observation_start
+FROM assets WHERE asset_type = ANY($1) AND active = 't'`
+
+// LoadAssetsFromDB returns all active assets of the given asset types
+func LoadAssetsFromDB(ctx context.Context, assetTypes []string) []*Asset {
+	return loadAssets(ctx, assetsQuery, assetTypes)
+}
+
+// LoadAssetsByTicker returns the active assets of the given asset types
+// with the given tickers
+func LoadAssetsByTicker(ctx context.Context, assetTypes []string, tickers []string) []*Asset {
+	return loadAssetsByTicker(ctx, assetsQuery, assetTypes, tickers)
+}
+
+// loadAssetsByTicker runs query, which selects the assets of assetTypes
+// as assetsQuery does, restricted to tickers and warns about tickers that
+// are not found
+func loadAssetsByTicker(ctx context.Context, query string, assetTypes []string, tickers []string) []*Asset {
+	canonical := make([]string, 0, len(tickers))
+	for _, name := range tickers {
+		ticker, err := CanonicalTicker(name)
+		if err != nil {
+			log.Warn().Err(err).Str("Ticker", name).Msg("invalid ticker")
+			continue
+		}
+		canonical = append(canonical, ticker)
+	}
+	tickers = canonical
+
+	assets := loadAssets(ctx, query+` AND ticker = ANY($2)`, assetTypes, tickers)
+
+	for _, ticker := range tickers {
+		found := false
+		for _, asset := range assets {
+			if asset.Ticker == ticker {
+				found = true
+				break
+			}
+		}
+		if !found {
+			log.Warn().Str("Ticker", ticker).Strs("AssetTypes", assetTypes).Msg("ticker is not an active asset")
+		}
+	}
+
+	return assets
+}
+
+func loadAssets(ctx context.Context, query string, args ...interface{}) (assets []*Asset) {
 	assets = make([]*Asset, 0, 5)
 
-	ctx := context.Background()
 	conn, err := pgx.Connect(ctx, viper.GetString("database.url"))
 	if err != nil {
 		log.Error().Err(err).Msg("Could not connect to database")
+		return
 	}
 	defer conn.Close(ctx)
 
-	rows, err := conn.Query(ctx, `SELECT composite_figi, ticker, asset_type FROM assets WHERE asset_type = 'FRED' AND active = 't'`)
+	rows, err := conn.Query(ctx, query, args...)
 	if err != nil {
-		log.Error().Err(err).Msg("could not retrieve FRED assets from the database")
+		log.Error().Err(err).Msg("could not retrieve assets from the database")
 		return
 	}
 
 	for rows.Next() {
 		var asset Asset
-		err = rows.Scan(&asset.CompositeFigi, &asset.Ticker, &asset.AssetType)
+		var lastDate *time.Time
+		var nativeFrequency *string
+		var observationStart *time.Time
+		err = rows.Scan(&asset.CompositeFigi, &asset.Ticker, &asset.AssetType, &lastDate, &nativeFrequency, &observationStart)
 		if err != nil {
 			log.Error().Err(err).Msg("error scanning row into asset")
 		}
+		if lastDate != nil {
+			asset.LastDate = *lastDate
+		}
+		if nativeFrequency != nil {
+			asset.NativeFrequency = *nativeFrequency
+		}
+		if observationStart != nil {
+			asset.ObservationStart = *observationStart
+		}
 		assets = append(assets, &asset)
-		log.Info().Str("Ticker", asset.Ticker).Msg("adding asset for download")
+		log.Info().Str("Ticker", asset.Ticker).Time("LastDate", asset.LastDate).Msg("adding asset for download")
 	}
 
 	return
 }
 
-func SaveToDatabase(quotes []*Eod) error {
-	log.Info().Msg("saving to database")
-	conn, err := pgx.Connect(context.Background(), viper.GetString("database.url"))
-	if err != nil {
-		log.Error().Err(err).Msg("Could not connect to database")
+// SaveResult counts how each quote was applied to the eod table
+type SaveResult struct {
+	Inserted  int
+	Updated   int
+	Unchanged int
+
+	// Revisions lists the stored values that were changed by the source
+	Revisions []*Revision
+}
+
+// upsertBatchSize is the number of quotes sent per pgx.Batch when the COPY
+// path is unavailable
+const upsertBatchSize = 1000
+
+var eodColumns = []string{
+	"ticker",
+	"composite_figi",
+	"event_date",
+	"open",
+	"high",
+	"low",
+	"close",
+	"volume",
+	"dividend",
+	"split_factor",
+	"source",
+	"frequency",
+}
+
+// eodFrequencyColumn records the frequency each observation was requested
+// at; Migrate adds it to existing eod tables
+const eodFrequencyColumn = `ALTER TABLE eod ADD COLUMN IF NOT EXISTS frequency TEXT`
+
+// eodUpdate only touches rows whose values actually changed so that
+// unchanged rows can be counted
+const eodUpdate = `ON CONFLICT ON CONSTRAINT eod_pkey
+	DO UPDATE SET
+		open = EXCLUDED.open,
+		high = EXCLUDED.high,
+		low = EXCLUDED.low,
+		close = EXCLUDED.close,
+		volume = EXCLUDED.volume,
+		dividend = EXCLUDED.dividend,
+		split_factor = EXCLUDED.split_factor,
+		source = EXCLUDED.source,
+		frequency = EXCLUDED.frequency
+	WHERE (eod.open, eod.high, eod.low, eod.close, eod.volume, eod.dividend, eod.split_factor, eod.source, eod.frequency)
+		IS DISTINCT FROM
+		(EXCLUDED.open, EXCLUDED.high, EXCLUDED.low, EXCLUDED.close, EXCLUDED.volume, EXCLUDED.dividend, EXCLUDED.split_factor, EXCLUDED.source, EXCLUDED.frequency)
+	RETURNING (xmax = 0) AS inserted`
+
+// eodMergeQuery merges the quotes staged in eod_staging into eod and
+// returns the number of inserted and updated rows. A quote may be staged
+// more than once (e.g. overlapping backfill chunks); the last one staged
+// is kept.
+func eodMergeQuery() string {
+	columns := strings.Join(eodColumns, ", ")
+	return `WITH merged AS (
+		INSERT INTO eod (` + columns + `)
+		SELECT DISTINCT ON (composite_figi, event_date) ` + columns + `
+		FROM eod_staging
+		ORDER BY composite_figi, event_date, ctid DESC
+		` + eodUpdate + `
+	)
+	SELECT count(*) FILTER (WHERE inserted), count(*) FILTER (WHERE NOT inserted) FROM merged`
+}
+
+// eodUpsertQuery upserts a single quote given as the parameters of eodRow
+func eodUpsertQuery() string {
+	placeholders := make([]string, len(eodColumns))
+	for idx := range eodColumns {
+		placeholders[idx] = fmt.Sprintf("$%d", idx+1)
 	}
-	defer conn.Close(context.Background())
-
-	for _, quote := range quotes {
-		_, err := conn.Exec(context.Background(),
-			`INSERT INTO eod (
-			"ticker",
-			"composite_figi",
-			"event_date",
-			"open",
-			"high",
-			"low",
-			"close",
-			"volume",
-			"dividend",
-			"split_factor",
-			"source"
-		) VALUES (
-			$1,
-			$2,
-			$3,
-			$4,
-			$5,
-			$6,
-			$7,
-			$8,
-			$9,
-			$10,
-			$11
-		) ON CONFLICT ON CONSTRAINT eod_pkey
-		DO UPDATE SET
-			open = EXCLUDED.open,
-			high = EXCLUDED.high,
-			low = EXCLUDED.low,
-			close = EXCLUDED.close,
-			volume = EXCLUDED.volume,
-			dividend = EXCLUDED.dividend,
-			split_factor = EXCLUDED.split_factor,
-			source = EXCLUDED.source;`,
-			quote.Ticker, quote.CompositeFigi, quote.Date,
-			quote.Open, quote.High, quote.Low, quote.Close, quote.Volume,
-			quote.Dividend, quote.Split, "fred.stlouisfed.org")
+	return `INSERT INTO eod (` + strings.Join(eodColumns, ", ") + `) VALUES (` + strings.Join(placeholders, ", ") + `) ` + eodUpdate
+}
+
+// saveQuotes upserts quotes in a single transaction, preferring the COPY
+// path and falling back to batched upserts
+func saveQuotes(ctx context.Context, conn *pgx.Conn, quotes []*Eod) (*SaveResult, error) {
+	result, err := copyQuotes(ctx, conn, quotes)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		log.Warn().Err(err).Msg("bulk copy into eod failed; falling back to batched upserts")
+		result, err = batchUpsertQuotes(ctx, conn, quotes)
 		if err != nil {
-			query := fmt.Sprintf(`INSERT INTO eod ("ticker", "composite_figi", "event_date", "open", "high", "low", "close", "volume", "dividend", "split_factor", "source") VALUES ('%s', '%s', '%s', %.5f, %.5f, %.5f, %.5f, %d, %.5f, %.5f, '%s') ON CONFLICT ON CONSTRAINT eod_pkey DO UPDATE SET open = EXCLUDED.open, high = EXCLUDED.high, low = EXCLUDED.low, close = EXCLUDED.close, volume = EXCLUDED.volume, dividend = EXCLUDED.dividend, split_factor = EXCLUDED.split_factor, source = EXCLUDED.source;`,
-				quote.Ticker, quote.CompositeFigi, quote.Date,
-				quote.Open, quote.High, quote.Low, quote.Close, quote.Volume,
-				quote.Dividend, quote.Split, "fred.stlouisfed.org")
-			log.Error().Err(err).Str("Query", query).Msg("error saving EOD quote to database")
+			log.Error().Err(err).Msg("error saving EOD quotes to database")
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// eodRow converts a quote into the column order of eodColumns
+func eodRow(quote *Eod) ([]interface{}, error) {
+	eventDate, err := time.Parse("2006-01-02", quote.Date)
+	if err != nil {
+		return nil, fmt.Errorf("invalid event date %q for %s: %w", quote.Date, quote.Ticker, err)
+	}
+
+	return []interface{}{
+		quote.Ticker, quote.CompositeFigi, eventDate,
+		quote.Open, quote.High, quote.Low, quote.Close, quote.Volume,
+		quote.Dividend, quote.Split, quote.Source, quote.Frequency,
+	}, nil
+}
+
+// copyQuotes COPYs quotes into a temporary staging table and merges them
+// into eod
+func copyQuotes(ctx context.Context, conn *pgx.Conn, quotes []*Eod) (*SaveResult, error) {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		// no-op once the transaction has been committed
+		_ = tx.Rollback(context.WithoutCancel(ctx))
+	}()
+
+	revisions, err := recordRevisions(ctx, tx, quotes)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = tx.Exec(ctx, `CREATE TEMPORARY TABLE eod_staging ON COMMIT DROP AS SELECT `+strings.Join(eodColumns, ", ")+` FROM eod WITH NO DATA`); err != nil {
+		return nil, err
+	}
+
+	staged, err := tx.CopyFrom(ctx, pgx.Identifier{"eod_staging"}, eodColumns, pgx.CopyFromSlice(len(quotes), func(idx int) ([]interface{}, error) {
+		return eodRow(quotes[idx])
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	result := &SaveResult{Revisions: revisions}
+	err = tx.QueryRow(ctx, eodMergeQuery()).Scan(&result.Inserted, &result.Updated)
+	if err != nil {
+		return nil, err
+	}
+
+	var distinct int
+	if err = tx.QueryRow(ctx, `SELECT count(*) FROM (SELECT DISTINCT composite_figi, event_date FROM eod_staging) AS d`).Scan(&distinct); err != nil {
+		return nil, err
+	}
+	result.Unchanged = distinct - result.Inserted - result.Updated
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	log.Debug().Int64("NumStaged", staged).Msg("merged staged quotes into eod")
+	return result, nil
+}
+
+// batchUpsertQuotes upserts quotes with batched INSERT ... ON CONFLICT
+// statements inside a single transaction
+func batchUpsertQuotes(ctx context.Context, conn *pgx.Conn, quotes []*Eod) (*SaveResult, error) {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		// no-op once the transaction has been committed
+		_ = tx.Rollback(context.WithoutCancel(ctx))
+	}()
+
+	revisions, err := recordRevisions(ctx, tx, quotes)
+	if err != nil {
+		return nil, err
+	}
+
+	query := eodUpsertQuery()
+
+	result := &SaveResult{Revisions: revisions}
+	for start := 0; start < len(quotes); start += upsertBatchSize {
+		end := start + upsertBatchSize
+		if end > len(quotes) {
+			end = len(quotes)
+		}
+
+		batch := &pgx.Batch{}
+		for _, quote := range quotes[start:end] {
+			row, err := eodRow(quote)
+			if err != nil {
+				return nil, err
+			}
+			batch.Queue(query, row...)
+		}
+
+		br := tx.SendBatch(ctx, batch)
+		for _, quote := range quotes[start:end] {
+			var inserted bool
+			err := br.QueryRow().Scan(&inserted)
+			switch {
+			case errors.Is(err, pgx.ErrNoRows):
+				result.Unchanged++
+			case err != nil:
+				check(br.Close(), "close batch results failed")
+				return nil, fmt.Errorf("upsert %s on %s: %w", quote.Ticker, quote.Date, err)
+			case inserted:
+				result.Inserted++
+			default:
+				result.Updated++
+			}
+		}
+
+		if err = br.Close(); err != nil {
+			return nil, err
 		}
 	}
 
-	return nil
+	if err = tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	return result, nil
 }
@@ -0,0 +1,267 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fred
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// testDatabaseEnv names the environment variable holding the url of a
+// scratch Postgres database. Tests that need a database are skipped when
+// it is not set.
+const testDatabaseEnv = "IMPORT_FRED_TEST_DATABASE_URL"
+
+// testEodTable is the penny-vault eod table, which import-fred does not
+// create itself
+const testEodTable = `CREATE TABLE eod (
+	ticker TEXT NOT NULL,
+	composite_figi TEXT NOT NULL,
+	event_date DATE NOT NULL,
+	open REAL,
+	high REAL,
+	low REAL,
+	close REAL,
+	volume BIGINT,
+	dividend REAL,
+	split_factor REAL,
+	source TEXT,
+	CONSTRAINT eod_pkey PRIMARY KEY (composite_figi, event_date)
+)`
+
+// testConn connects to the test database and creates eod and the tables
+// import-fred owns in a private schema that is dropped when the test ends
+func testConn(t *testing.T) *pgx.Conn {
+	t.Helper()
+
+	url := os.Getenv(testDatabaseEnv)
+	if url == "" {
+		t.Skipf("%s is not set", testDatabaseEnv)
+	}
+
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, url)
+	if err != nil {
+		t.Fatalf("could not connect to test database: %v", err)
+	}
+
+	schema := pgx.Identifier{fmt.Sprintf("import_fred_test_%d", time.Now().UnixNano())}.Sanitize()
+	t.Cleanup(func() {
+		if _, err := conn.Exec(ctx, `DROP SCHEMA IF EXISTS `+schema+` CASCADE`); err != nil {
+			t.Errorf("could not drop test schema: %v", err)
+		}
+		conn.Close(ctx)
+	})
+
+	statements := []string{`CREATE SCHEMA ` + schema, `SET search_path TO ` + schema, testEodTable, eodFrequencyColumn}
+	for _, table := range schemaTables {
+		statements = append(statements, table.ddl)
+	}
+	for _, stmt := range statements {
+		if _, err = conn.Exec(ctx, stmt); err != nil {
+			t.Fatalf("could not set up test schema: %v\n%s", err, stmt)
+		}
+	}
+
+	return conn
+}
+
+// storedCloses returns the close of each stored quote of figi by date
+func storedCloses(t *testing.T, conn *pgx.Conn, figi string) map[string]float64 {
+	t.Helper()
+
+	rows, err := conn.Query(context.Background(), `SELECT event_date, close FROM eod WHERE composite_figi = $1`, figi)
+	if err != nil {
+		t.Fatalf("could not read eod: %v", err)
+	}
+	defer rows.Close()
+
+	closes := make(map[string]float64)
+	for rows.Next() {
+		var eventDate time.Time
+		var value float64
+		if err = rows.Scan(&eventDate, &value); err != nil {
+			t.Fatalf("could not read eod: %v", err)
+		}
+		closes[eventDate.Format("2006-01-02")] = value
+	}
+	if err = rows.Err(); err != nil {
+		t.Fatalf("could not read eod: %v", err)
+	}
+	return closes
+}
+
+func testQuote(date string, value float64) *Eod {
+	return &Eod{
+		Date:          date,
+		Ticker:        "DGS10",
+		Exchange:      ExchangeFRED,
+		AssetType:     AssetTypeFRED,
+		CompositeFigi: "FRED:DGS10",
+		Open:          value,
+		High:          value,
+		Low:           value,
+		Close:         value,
+		Split:         1,
+		Frequency:     FrequencyNative,
+		Source:        "api.stlouisfed.org",
+	}
+}
+
+type saveFunc func(context.Context, *pgx.Conn, []*Eod) (*SaveResult, error)
+
+var savePaths = []struct {
+	name string
+	save saveFunc
+}{
+	{"copy", copyQuotes},
+	{"batch", batchUpsertQuotes},
+}
+
+func TestSaveQuotesCounts(t *testing.T) {
+	for _, path := range savePaths {
+		t.Run(path.name, func(t *testing.T) {
+			conn := testConn(t)
+			ctx := context.Background()
+
+			result, err := path.save(ctx, conn, []*Eod{testQuote("2022-01-03", 1), testQuote("2022-01-04", 2)})
+			if err != nil {
+				t.Fatalf("first save error = %v", err)
+			}
+			if result.Inserted != 2 || result.Updated != 0 || result.Unchanged != 0 {
+				t.Errorf("first save = %d inserted, %d updated, %d unchanged, want 2, 0, 0", result.Inserted, result.Updated, result.Unchanged)
+			}
+
+			result, err = path.save(ctx, conn, []*Eod{testQuote("2022-01-03", 1), testQuote("2022-01-04", 2.5), testQuote("2022-01-05", 3)})
+			if err != nil {
+				t.Fatalf("second save error = %v", err)
+			}
+			if result.Inserted != 1 || result.Updated != 1 || result.Unchanged != 1 {
+				t.Errorf("second save = %d inserted, %d updated, %d unchanged, want 1, 1, 1", result.Inserted, result.Updated, result.Unchanged)
+			}
+			if len(result.Revisions) != 1 || result.Revisions[0].OldValue != 2 || result.Revisions[0].NewValue != 2.5 {
+				t.Errorf("second save revisions = %v, want 2022-01-04 revised from 2 to 2.5", result.Revisions)
+			}
+
+			want := map[string]float64{"2022-01-03": 1, "2022-01-04": 2.5, "2022-01-05": 3}
+			if got := storedCloses(t, conn, "FRED:DGS10"); !reflect.DeepEqual(got, want) {
+				t.Errorf("stored closes = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestSaveQuotesDuplicateDates(t *testing.T) {
+	tests := []struct {
+		path     string
+		save     saveFunc
+		inserted int
+		updated  int
+	}{
+		// COPY merges the distinct dates once
+		{"copy", copyQuotes, 1, 0},
+		// upserts are applied in order, so the later quote updates the
+		// one inserted before it
+		{"batch", batchUpsertQuotes, 1, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			conn := testConn(t)
+
+			quotes := []*Eod{testQuote("2022-01-03", 1), testQuote("2022-01-03", 1.5)}
+			result, err := tt.save(context.Background(), conn, quotes)
+			if err != nil {
+				t.Fatalf("save error = %v", err)
+			}
+			if result.Inserted != tt.inserted || result.Updated != tt.updated {
+				t.Errorf("save = %d inserted, %d updated, want %d, %d", result.Inserted, result.Updated, tt.inserted, tt.updated)
+			}
+
+			// the last quote for a date wins
+			want := map[string]float64{"2022-01-03": 1.5}
+			if got := storedCloses(t, conn, "FRED:DGS10"); !reflect.DeepEqual(got, want) {
+				t.Errorf("stored closes = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestSaveQuotesFallsBackToBatch(t *testing.T) {
+	conn := testConn(t)
+	ctx := context.Background()
+
+	// a staging table left in the session makes the COPY path fail
+	if _, err := conn.Exec(ctx, `CREATE TEMPORARY TABLE eod_staging (id INT)`); err != nil {
+		t.Fatalf("could not create conflicting staging table: %v", err)
+	}
+
+	result, err := saveQuotes(ctx, conn, []*Eod{testQuote("2022-01-03", 1), testQuote("2022-01-04", 2)})
+	if err != nil {
+		t.Fatalf("saveQuotes() error = %v", err)
+	}
+	if result.Inserted != 2 {
+		t.Errorf("saveQuotes() inserted %d, want 2", result.Inserted)
+	}
+
+	want := map[string]float64{"2022-01-03": 1, "2022-01-04": 2}
+	if got := storedCloses(t, conn, "FRED:DGS10"); !reflect.DeepEqual(got, want) {
+		t.Errorf("stored closes = %v, want %v", got, want)
+	}
+}
+
+func TestEodRow(t *testing.T) {
+	quote := &Eod{
+		Date:          "2022-01-03",
+		Ticker:        "DGS10",
+		CompositeFigi: "FRED:DGS10",
+		Open:          1.5,
+		High:          1.5,
+		Low:           1.5,
+		Close:         1.5,
+		Split:         1,
+		Source:        "fred.stlouisfed.org",
+		Frequency:     "d",
+	}
+
+	row, err := eodRow(quote)
+	if err != nil {
+		t.Fatalf("eodRow() error = %v", err)
+	}
+
+	want := []interface{}{
+		"DGS10", "FRED:DGS10", time.Date(2022, 1, 3, 0, 0, 0, 0, time.UTC),
+		1.5, 1.5, 1.5, 1.5, int64(0),
+		0.0, 1.0, "fred.stlouisfed.org", "d",
+	}
+	if len(row) != len(eodColumns) {
+		t.Fatalf("len(row) = %d, want one value per column (%d)", len(row), len(eodColumns))
+	}
+	if !reflect.DeepEqual(row, want) {
+		t.Errorf("eodRow() = %v, want %v", row, want)
+	}
+
+	quote.Date = "01/03/2022"
+	if _, err = eodRow(quote); err == nil {
+		t.Error("eodRow() with an invalid date succeeded")
+	}
+}
@@ -0,0 +1,421 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fred
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+const (
+	AssetTypeDerived = "DERIVED"
+	ExchangeDerived  = "PVDERIVED"
+	LabelDerived     = "derived.pennyvault.com"
+)
+
+var (
+	ErrDerivedCycle   = errors.New("derived series depend on each other")
+	ErrUnknownInput   = errors.New("derived series input is not an active asset")
+	ErrAmbiguousInput = errors.New("derived series input matches more than one asset")
+)
+
+// DerivedSeries is a series computed from other stored series, e.g. the
+// 10Y-3M spread `DGS10 - DGS3MO`
+type DerivedSeries struct {
+	Ticker     string
+	Expression *Expression
+}
+
+// CompositeFigi is the synthetic identifier the derived series is stored
+// under
+func (d *DerivedSeries) CompositeFigi() string {
+	return SyntheticFigi(AssetTypeDerived, d.Ticker)
+}
+
+// DerivedSeriesFromConfig parses the `derived.<ticker> = "<expression>"`
+// configuration values. Derived series may reference each other; they are
+// returned in an order in which every series follows its inputs.
+func DerivedSeriesFromConfig() ([]*DerivedSeries, error) {
+	config := viper.GetStringMapString("derived")
+
+	byTicker := make(map[string]*DerivedSeries, len(config))
+	for name, source := range config {
+		expr, err := ParseExpression(source)
+		if err != nil {
+			return nil, fmt.Errorf("derived series %s: %w", name, err)
+		}
+		ticker := strings.ToUpper(name)
+		byTicker[ticker] = &DerivedSeries{Ticker: ticker, Expression: expr}
+	}
+
+	tickers := make([]string, 0, len(byTicker))
+	for ticker := range byTicker {
+		tickers = append(tickers, ticker)
+	}
+	sort.Strings(tickers)
+
+	// repeatedly emit every series whose derived inputs are already
+	// ordered; a pass without progress means there is a cycle
+	ordered := make([]*DerivedSeries, 0, len(byTicker))
+	done := make(map[string]bool, len(byTicker))
+	for len(ordered) < len(byTicker) {
+		progress := false
+		for _, ticker := range tickers {
+			if done[ticker] {
+				continue
+			}
+
+			ready := true
+			for _, input := range byTicker[ticker].Expression.Tickers() {
+				if _, derived := byTicker[input]; derived && !done[input] {
+					ready = false
+					break
+				}
+			}
+
+			if ready {
+				ordered = append(ordered, byTicker[ticker])
+				done[ticker] = true
+				progress = true
+			}
+		}
+
+		if !progress {
+			pending := make([]string, 0)
+			for _, ticker := range tickers {
+				if !done[ticker] {
+					pending = append(pending, ticker)
+				}
+			}
+			return nil, fmt.Errorf("%w: %s", ErrDerivedCycle, strings.Join(pending, ", "))
+		}
+	}
+
+	return ordered, nil
+}
+
+// ComputeDerived evaluates each derived series on every trading day on
+// which all of its inputs have a stored value and saves the result to the
+// eod table. Values computed from a forward-filled input are labeled as
+// filled (source api.pennyvault.com) like the input. The full history is
+// recomputed so that revisions and backfills of the inputs are reflected,
+// but only the values that changed are written and values that can no
+// longer be computed are removed. Changes of derived values are not
+// recorded as revisions. Each derived series is registered as an active
+// asset of type DERIVED. Inputs are resolved among the active assets of
+// the given asset types and other derived series.
+func ComputeDerived(ctx context.Context, derived []*DerivedSeries, assetTypes []string) error {
+	conn, err := pgx.Connect(ctx, viper.GetString("database.url"))
+	if err != nil {
+		log.Error().Err(err).Msg("Could not connect to database")
+		return err
+	}
+	defer conn.Close(ctx)
+
+	inputTypes := append(append(make([]string, 0, len(assetTypes)+1), assetTypes...), AssetTypeDerived)
+
+	var lastErr error
+	for _, series := range derived {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		subLog := log.With().Str("Ticker", series.Ticker).Str("Expression", series.Expression.String()).Logger()
+
+		quotes, err := computeDerived(ctx, conn, series, inputTypes)
+		if err != nil {
+			subLog.Error().Err(err).Msg("could not compute derived series")
+			lastErr = err
+			continue
+		}
+
+		asset := &Asset{
+			CompositeFigi: series.CompositeFigi(),
+			Ticker:        series.Ticker,
+			AssetType:     AssetTypeDerived,
+		}
+		if err = registerAsset(ctx, conn, asset); err != nil {
+			subLog.Error().Err(err).Msg("could not register derived series")
+			lastErr = err
+			continue
+		}
+
+		// the series may already be registered under another figi
+		for _, quote := range quotes {
+			quote.CompositeFigi = asset.CompositeFigi
+		}
+
+		stored, err := storedDerived(ctx, conn, asset.CompositeFigi)
+		if err != nil {
+			subLog.Error().Err(err).Msg("could not load stored derived values")
+			lastErr = err
+			continue
+		}
+
+		changed, stale := derivedChanges(quotes, stored)
+		if len(changed) > 0 {
+			if _, err = saveQuotes(ctx, conn, changed); err != nil {
+				subLog.Error().Err(err).Msg("could not save derived series")
+				lastErr = err
+				continue
+			}
+		}
+		if len(stale) > 0 {
+			if _, err = conn.Exec(ctx, `DELETE FROM eod WHERE composite_figi = $1 AND event_date = ANY($2::date[])`, asset.CompositeFigi, stale); err != nil {
+				subLog.Error().Err(err).Msg("could not remove stale derived values")
+				lastErr = err
+				continue
+			}
+		}
+
+		subLog.Info().Int("NumQuotes", len(quotes)).Int("NumChanged", len(changed)).Int("NumRemoved", len(stale)).Msg("derived series updated")
+	}
+
+	return lastErr
+}
+
+// derivedInput is a stored value of an input of a derived series
+type derivedInput struct {
+	value  float64
+	filled bool
+}
+
+// computeDerived loads the stored values of each input and evaluates the
+// expression on the trading days on which every input has a value.
+func computeDerived(ctx context.Context, conn *pgx.Conn, series *DerivedSeries, assetTypes []string) ([]*Eod, error) {
+	tickers := series.Expression.Tickers()
+
+	inputs := make(map[string]map[time.Time]derivedInput, len(tickers))
+	var start time.Time
+	for _, ticker := range tickers {
+		figi, err := inputFigi(ctx, conn, ticker, assetTypes)
+		if err != nil {
+			return nil, err
+		}
+
+		values, first, err := loadDerivedInput(ctx, conn, figi)
+		if err != nil {
+			return nil, err
+		}
+		if len(values) == 0 {
+			log.Warn().Str("Ticker", series.Ticker).Str("Input", ticker).Msg("derived series input has no stored values")
+			return []*Eod{}, nil
+		}
+		inputs[ticker] = values
+
+		if first.After(start) {
+			start = first
+		}
+	}
+
+	rows, err := conn.Query(ctx, "SELECT trading_day FROM trading_days WHERE trading_day >= $1 AND trading_day <= $2 ORDER BY trading_day ASC", start, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	days := make([]time.Time, 0, 252)
+	for rows.Next() {
+		var day time.Time
+		if err = rows.Scan(&day); err != nil {
+			return nil, err
+		}
+		days = append(days, day)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return evaluateDerived(series, inputs, days), nil
+}
+
+// loadDerivedInput returns the stored values of figi by event date and
+// the first event date
+func loadDerivedInput(ctx context.Context, conn *pgx.Conn, figi string) (map[time.Time]derivedInput, time.Time, error) {
+	rows, err := conn.Query(ctx, "SELECT event_date, close, source IS NOT DISTINCT FROM 'api.pennyvault.com' FROM eod WHERE composite_figi=$1 ORDER BY event_date ASC", figi)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer rows.Close()
+
+	values := make(map[time.Time]derivedInput)
+	var first time.Time
+	for rows.Next() {
+		var day time.Time
+		var input derivedInput
+		if err = rows.Scan(&day, &input.value, &input.filled); err != nil {
+			return nil, time.Time{}, err
+		}
+		if first.IsZero() {
+			first = day
+		}
+		values[day] = input
+	}
+
+	return values, first, rows.Err()
+}
+
+// evaluateDerived evaluates the expression on each of days on which every
+// input has a value. Values that depend on a forward-filled input are
+// labeled as filled. Results that are not finite (e.g. division by zero)
+// are skipped.
+func evaluateDerived(series *DerivedSeries, inputs map[string]map[time.Time]derivedInput, days []time.Time) []*Eod {
+	tickers := series.Expression.Tickers()
+	figi := series.CompositeFigi()
+	quotes := make([]*Eod, 0, len(days))
+	values := make(map[string]float64, len(tickers))
+	for _, day := range days {
+		complete := true
+		filled := false
+		for _, ticker := range tickers {
+			input, ok := inputs[ticker][day]
+			if !ok {
+				complete = false
+				break
+			}
+			values[ticker] = input.value
+			filled = filled || input.filled
+		}
+		if !complete {
+			continue
+		}
+
+		result := series.Expression.Eval(values)
+		if math.IsNaN(result) || math.IsInf(result, 0) {
+			continue
+		}
+
+		source := LabelDerived
+		if filled {
+			source = "api.pennyvault.com"
+		}
+
+		quotes = append(quotes, &Eod{
+			Date:          day.Format("2006-01-02"),
+			Ticker:        series.Ticker,
+			Exchange:      ExchangeDerived,
+			AssetType:     AssetTypeDerived,
+			CompositeFigi: figi,
+			Open:          result,
+			High:          result,
+			Low:           result,
+			Close:         result,
+			Split:         1,
+			Frequency:     FrequencyDaily,
+			Source:        source,
+		})
+	}
+
+	return quotes
+}
+
+// storedValue is a value of a derived series stored in eod
+type storedValue struct {
+	close  float64
+	source string
+}
+
+// storedDerived returns the stored values of the derived series figi keyed
+// by event date (YYYY-MM-DD)
+func storedDerived(ctx context.Context, conn *pgx.Conn, figi string) (map[string]storedValue, error) {
+	rows, err := conn.Query(ctx, "SELECT event_date, close, source FROM eod WHERE composite_figi=$1", figi)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stored := make(map[string]storedValue)
+	for rows.Next() {
+		var day time.Time
+		var val storedValue
+		var source *string
+		if err = rows.Scan(&day, &val.close, &source); err != nil {
+			return nil, err
+		}
+		if source != nil {
+			val.source = *source
+		}
+		stored[day.Format("2006-01-02")] = val
+	}
+
+	return stored, rows.Err()
+}
+
+// derivedChanges compares the computed quotes of a derived series with its
+// stored values. It returns the quotes that are new or whose value or
+// label changed, and the dates of stored values that were not computed.
+func derivedChanges(quotes []*Eod, stored map[string]storedValue) (changed []*Eod, stale []string) {
+	computed := make(map[string]bool, len(quotes))
+	for _, quote := range quotes {
+		computed[quote.Date] = true
+
+		val, ok := stored[quote.Date]
+		if !ok || val.source != quote.Source || !sameValue(val.close, quote.Close) {
+			changed = append(changed, quote)
+		}
+	}
+
+	for date := range stored {
+		if !computed[date] {
+			stale = append(stale, date)
+		}
+	}
+	sort.Strings(stale)
+
+	return changed, stale
+}
+
+// inputFigi returns the composite figi of the active asset of one of the
+// given asset types with the given ticker. The assets table is shared with
+// other importers, so assets of other types (e.g. an equity with the same
+// ticker) are ignored.
+func inputFigi(ctx context.Context, conn *pgx.Conn, ticker string, assetTypes []string) (string, error) {
+	rows, err := conn.Query(ctx, `SELECT composite_figi FROM assets WHERE ticker = $1 AND asset_type = ANY($2) AND active = 't'`, ticker, assetTypes)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	figis := make([]string, 0, 1)
+	for rows.Next() {
+		var figi string
+		if err = rows.Scan(&figi); err != nil {
+			return "", err
+		}
+		figis = append(figis, figi)
+	}
+	if err = rows.Err(); err != nil {
+		return "", err
+	}
+
+	switch len(figis) {
+	case 0:
+		return "", fmt.Errorf("%w: %s", ErrUnknownInput, ticker)
+	case 1:
+		return figis[0], nil
+	default:
+		return "", fmt.Errorf("%w: %s", ErrAmbiguousInput, ticker)
+	}
+}
@@ -0,0 +1,224 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fred
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestDerivedSeriesFromConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  map[string]string
+		tickers []string
+		err     error
+	}{
+		{
+			name:    "empty",
+			config:  map[string]string{},
+			tickers: []string{},
+		},
+		{
+			name:    "independent series are sorted",
+			config:  map[string]string{"t10y3m": "DGS10 - DGS3MO", "real10y": "DGS10 - T10YIE"},
+			tickers: []string{"REAL10Y", "T10Y3M"},
+		},
+		{
+			name:    "inputs come first",
+			config:  map[string]string{"a": "c * 2", "b": "DGS10 + 1", "c": "b - DGS3MO"},
+			tickers: []string{"B", "C", "A"},
+		},
+		{
+			name:   "self reference",
+			config: map[string]string{"a": "a + 1"},
+			err:    ErrDerivedCycle,
+		},
+		{
+			name:   "cycle",
+			config: map[string]string{"a": "b + 1", "b": "a - 1", "c": "DGS10"},
+			err:    ErrDerivedCycle,
+		},
+		{
+			name:   "cycle through an ordered series",
+			config: map[string]string{"a": "c + 1", "b": "a - 1", "c": "b * 2", "d": "DGS10"},
+			err:    ErrDerivedCycle,
+		},
+		{
+			name:   "invalid expression",
+			config: map[string]string{"a": "DGS10 +"},
+			err:    ErrInvalidExpression,
+		},
+	}
+
+	t.Cleanup(func() { viper.Set("derived", nil) })
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			viper.Set("derived", tt.config)
+
+			derived, err := DerivedSeriesFromConfig()
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("DerivedSeriesFromConfig() error = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DerivedSeriesFromConfig() error = %v", err)
+			}
+
+			tickers := make([]string, len(derived))
+			for idx, series := range derived {
+				tickers[idx] = series.Ticker
+			}
+			if !reflect.DeepEqual(tickers, tt.tickers) {
+				t.Errorf("DerivedSeriesFromConfig() = %v, want %v", tickers, tt.tickers)
+			}
+		})
+	}
+}
+
+func TestEvaluateDerived(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2022, 1, d, 0, 0, 0, 0, time.UTC) }
+
+	expr, err := ParseExpression("DGS10 / DGS3MO")
+	if err != nil {
+		t.Fatalf("ParseExpression() error = %v", err)
+	}
+	series := &DerivedSeries{Ticker: "RATIO", Expression: expr}
+
+	inputs := map[string]map[time.Time]derivedInput{
+		"DGS10": {
+			day(3): {value: 4},
+			day(4): {value: 5, filled: true},
+			day(5): {value: 6},
+			day(6): {value: 7},
+		},
+		"DGS3MO": {
+			day(3): {value: 2},
+			day(4): {value: 2},
+			day(5): {value: 0},
+			day(7): {value: 1},
+		},
+	}
+
+	quotes := evaluateDerived(series, inputs, []time.Time{day(3), day(4), day(5), day(6), day(7)})
+
+	want := []struct {
+		date   string
+		close  float64
+		source string
+	}{
+		{"2022-01-03", 2, LabelDerived},
+		{"2022-01-04", 2.5, "api.pennyvault.com"},
+	}
+	if len(quotes) != len(want) {
+		t.Fatalf("evaluateDerived() returned %d quotes, want %d", len(quotes), len(want))
+	}
+	for idx, w := range want {
+		q := quotes[idx]
+		if q.Date != w.date || q.Close != w.close || q.Source != w.source {
+			t.Errorf("quote %d = {%s %v %s}, want {%s %v %s}", idx, q.Date, q.Close, q.Source, w.date, w.close, w.source)
+		}
+		if q.Exchange != ExchangeDerived || q.CompositeFigi != series.CompositeFigi() {
+			t.Errorf("quote %d exchange, figi = %s, %s", idx, q.Exchange, q.CompositeFigi)
+		}
+	}
+}
+
+func TestDerivedChanges(t *testing.T) {
+	quote := func(date string, close float64, source string) *Eod {
+		return &Eod{Date: date, Close: close, Source: source}
+	}
+
+	tests := []struct {
+		name    string
+		quotes  []*Eod
+		stored  map[string]storedValue
+		changed []string
+		stale   []string
+	}{
+		{
+			name:    "nothing stored",
+			quotes:  []*Eod{quote("2022-01-03", 1, LabelDerived), quote("2022-01-04", 2, LabelDerived)},
+			stored:  map[string]storedValue{},
+			changed: []string{"2022-01-03", "2022-01-04"},
+		},
+		{
+			name:   "unchanged",
+			quotes: []*Eod{quote("2022-01-03", 1, LabelDerived), quote("2022-01-04", 2, LabelDerived)},
+			stored: map[string]storedValue{
+				"2022-01-03": {1, LabelDerived},
+				"2022-01-04": {2, LabelDerived},
+			},
+		},
+		{
+			name:   "stored in single precision",
+			quotes: []*Eod{quote("2022-01-03", 1.1, LabelDerived)},
+			stored: map[string]storedValue{"2022-01-03": {float64(float32(1.1)), LabelDerived}},
+		},
+		{
+			name:    "appended",
+			quotes:  []*Eod{quote("2022-01-03", 1, LabelDerived), quote("2022-01-04", 2, LabelDerived)},
+			stored:  map[string]storedValue{"2022-01-03": {1, LabelDerived}},
+			changed: []string{"2022-01-04"},
+		},
+		{
+			name:    "input revised",
+			quotes:  []*Eod{quote("2022-01-03", 1.5, LabelDerived), quote("2022-01-04", 2, LabelDerived)},
+			stored:  map[string]storedValue{"2022-01-03": {1, LabelDerived}, "2022-01-04": {2, LabelDerived}},
+			changed: []string{"2022-01-03"},
+		},
+		{
+			name:    "fill replaced by an observation",
+			quotes:  []*Eod{quote("2022-01-03", 2, LabelDerived)},
+			stored:  map[string]storedValue{"2022-01-03": {2, "api.pennyvault.com"}},
+			changed: []string{"2022-01-03"},
+		},
+		{
+			name:   "no longer computed",
+			quotes: []*Eod{quote("2022-01-04", 2, LabelDerived)},
+			stored: map[string]storedValue{
+				"2022-01-05": {3, LabelDerived},
+				"2022-01-03": {1, LabelDerived},
+				"2022-01-04": {2, LabelDerived},
+			},
+			stale: []string{"2022-01-03", "2022-01-05"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changed, stale := derivedChanges(tt.quotes, tt.stored)
+
+			dates := make([]string, 0, len(changed))
+			for _, quote := range changed {
+				dates = append(dates, quote.Date)
+			}
+			if len(dates) != len(tt.changed) || (len(dates) > 0 && !reflect.DeepEqual(dates, tt.changed)) {
+				t.Errorf("changed = %v, want %v", dates, tt.changed)
+			}
+			if len(stale) != len(tt.stale) || (len(stale) > 0 && !reflect.DeepEqual(stale, tt.stale)) {
+				t.Errorf("stale = %v, want %v", stale, tt.stale)
+			}
+		})
+	}
+}
@@ -16,120 +16,239 @@ limitations under the License.
 package fred
 
 import (
-	"fmt"
-	"strconv"
-	"strings"
+	"context"
 	"time"
 
-	"github.com/go-resty/resty/v2"
 	"github.com/rs/zerolog/log"
 	"github.com/schollz/progressbar/v3"
 	"github.com/spf13/viper"
-	"github.com/xitongsys/parquet-go-source/local"
-	"github.com/xitongsys/parquet-go/parquet"
-	"github.com/xitongsys/parquet-go/writer"
 	"go.uber.org/ratelimit"
 )
 
-func SaveToParquet(records []*Eod, fn string) error {
-	var err error
-
-	fh, err := local.NewLocalFileWriter(fn)
-	if err != nil {
-		log.Error().Err(err).Str("FileName", fn).Msg("cannot create local file")
-		return err
+// FullHistoryStart is the earliest observation date supported by FRED. It
+// is used to request the complete history of a series
+var FullHistoryStart = time.Date(1776, 7, 4, 0, 0, 0, 0, time.UTC)
+
+// fetchStart returns the first date to request for the asset. Downloads
+// resume from the last stored observation minus the overlap window so
+// that revised values are picked up; assets without any stored
+// observations download their full history.
+func fetchStart(asset *Asset, overlap time.Duration) time.Time {
+	if asset.LastDate.IsZero() {
+		return FullHistoryStart
 	}
-	defer fh.Close()
+	return asset.LastDate.Add(-overlap)
+}
 
-	pw, err := writer.NewParquetWriter(fh, new(Eod), 4)
-	if err != nil {
-		log.Error().
-			Str("OriginalError", err.Error()).
-			Msg("Parquet write failed")
-		return err
+// backfillStart returns the first date to request when backfilling the
+// asset since the given date. Requests before the first observation of
+// the series only return empty chunks, so the start is moved to the first
+// observation when it is known.
+func backfillStart(asset *Asset, since time.Time) time.Time {
+	if asset.ObservationStart.After(since) {
+		return asset.ObservationStart
 	}
+	return since
+}
 
-	pw.RowGroupSize = 128 * 1024 * 1024 // 128M
-	pw.PageSize = 8 * 1024              // 8k
-	pw.CompressionType = parquet.CompressionCodec_GZIP
-
-	for _, r := range records {
-		if err = pw.Write(r); err != nil {
-			log.Error().
-				Str("OriginalError", err.Error()).
-				Str("EventDate", r.Date).Str("Ticker", r.Ticker).
-				Str("CompositeFigi", r.CompositeFigi).
-				Msg("Parquet write failed for record")
-		}
+// downloadFrequency returns the frequency to request the asset at. FRED
+// rejects frequencies higher than the native one, so when a frequency is
+// configured but the native frequency is not known yet (e.g. the first run
+// after add-series, before series_metadata is saved) the series is
+// described first. Series that cannot be described are requested at their
+// native frequency.
+func downloadFrequency(ctx context.Context, src Source, asset *Asset, limit ratelimit.Limiter) (Frequency, error) {
+	freq, err := FrequencyFor(asset)
+	if err != nil || freq.IsNative() || asset.NativeFrequency != "" || asset.Series != nil {
+		return freq, err
 	}
 
-	if err = pw.WriteStop(); err != nil {
-		log.Error().Err(err).Msg("Parquet write failed")
-		return err
+	var series *Series
+	_, err = withRetry(ctx, asset.Ticker, func() (err error) {
+		limit.Take()
+		series, err = src.DescribeSeries(context.WithoutCancel(ctx), asset.Ticker)
+		return
+	})
+	if err != nil {
+		log.Warn().Err(err).Str("Ticker", asset.Ticker).Stringer("Frequency", freq).Msg("native frequency of series is unknown; using its native frequency")
+		return NativeFrequency, nil
 	}
 
-	log.Info().Int("NumRecords", len(records)).Msg("Parquet write finished")
-	return nil
+	asset.Series = series
+	return FrequencyFor(asset)
 }
 
-func Fetch(assets []*Asset) []*Eod {
+// Fetch downloads observations for each asset from the source responsible
+// for its asset type, starting from its last stored observation. Assets
+// are downloaded concurrently by a pool of workers that share the rate
+// limit; transient errors are retried with exponential backoff. The
+// observations of each asset are written to sink as soon as they arrive
+// and are not retained in the returned results, which are in asset order.
+//
+// When ctx is done no new assets are started; assets already in progress
+// run to completion and the remaining assets are reported as canceled.
+func Fetch(ctx context.Context, sources Sources, assets []*Asset, sink Sink) []*AssetResult {
 	// fred rate limits
 	limit := ratelimit.New(viper.GetInt("fred_rate_limit"))
+	overlap := viper.GetDuration("fetch_overlap")
 
-	quotes := []*Eod{}
-	client := resty.New()
-	startDate := time.Now().Add(-7 * 24 * time.Hour)
-	startDateStr := startDate.Format("2006-01-02")
+	results := make([]*AssetResult, len(assets))
 	today := time.Now()
-	todayStr := today.Format("2006-01-02")
 
+	emit, wait := stream(ctx, sink)
 	bar := progressbar.Default(int64(len(assets)))
-	for _, asset := range assets {
-		check(bar.Add(1), "add to progressbar failed")
-		limit.Take()
-		url := fmt.Sprintf("https://fred.stlouisfed.org/graph/fredgraph.csv?mode=fred&id=%s&cosd=%s&coed=%s&fq=Daily&fam=avg", asset.Ticker, startDateStr, todayStr)
-		log.Debug().Str("Url", url).Msg("Loading URL")
-		resp, err := client.
-			R().
-			SetHeader("Accept", "application/csv").
-			Get(url)
+	forEach(ctx, len(assets), numWorkers(), func(idx int) {
+		asset := assets[idx]
+		result := &AssetResult{Asset: asset}
+		results[idx] = result
+		defer func() {
+			emit(idx, result)
+			check(bar.Add(1), "add to progressbar failed")
+		}()
+
+		src, err := sources.For(asset)
+		if err != nil {
+			log.Error().Err(err).Str("Ticker", asset.Ticker).Msg("cannot fetch asset")
+			result.Err = err
+			return
+		}
+
+		freq, err := downloadFrequency(ctx, src, asset, limit)
 		if err != nil {
-			log.Error().Err(err).Str("Url", url).Msg("error when requesting eod quote")
-			continue
+			log.Error().Err(err).Str("Ticker", asset.Ticker).Msg("invalid frequency")
+			result.Err = err
+			return
 		}
-		if resp.StatusCode() >= 400 {
-			log.Error().Int("StatusCode", resp.StatusCode()).Str("Url", url).Bytes("Body", resp.Body()).Msg("error when requesting eod quote")
-			continue
+
+		startDate := fetchStart(asset, overlap)
+		log.Debug().Str("Ticker", asset.Ticker).Str("Source", src.Name()).Time("StartDate", startDate).Stringer("Frequency", freq).Msg("fetching observations")
+
+		// let the current asset finish even if the run is stopped
+		reqCtx := context.WithoutCancel(ctx)
+
+		var observations, vintages []*Observation
+		result.Retries, result.Err = withRetry(ctx, asset.Ticker, func() (err error) {
+			limit.Take()
+			observations, vintages, err = download(reqCtx, src, asset.Ticker, startDate, today, freq)
+			return
+		})
+		if result.Err != nil {
+			log.Error().Err(result.Err).Str("Ticker", asset.Ticker).Int("Retries", result.Retries).Msg("error when requesting eod quote")
+			return
 		}
-		data := string(resp.Body())
-		lines := strings.Split(data, "\n")
-		for _, ll := range lines[1:] {
-			parts := strings.Split(ll, ",")
-			if len(parts) == 2 {
-				if parts[1] == "." {
-					continue
-				}
-				val, err := strconv.ParseFloat(parts[1], 32)
-				if err != nil {
-					log.Warn().Str("Line", ll).Str("Ticker", asset.Ticker).Str("Val", parts[1]).Err(err).Msg("could not convert str to float")
-				}
-				val32 := float32(val)
-				q := Eod{
-					Date:          parts[0],
-					Ticker:        asset.Ticker,
-					Exchange:      "FRED",
-					AssetType:     asset.AssetType,
-					CompositeFigi: asset.CompositeFigi,
-					Open:          val32,
-					High:          val32,
-					Low:           val32,
-					Close:         val32,
-					Split:         1,
+
+		result.Quotes = observationsToEod(src, asset, freq, observations)
+		result.Vintages = observationsToVintages(src, asset, vintages)
+	})
+	wait()
+
+	return fillCanceled(ctx, assets, results)
+}
+
+// Backfill downloads the complete observation range between since and
+// until for each asset, starting no earlier than the first observation of
+// the series when it is known. Requests are split into chunks of
+// chunkYears to keep individual responses small, and each chunk is
+// written to sink as soon as it has been downloaded. An asset is reported
+// as failed if any of its chunks could not be downloaded or saved; the
+// other chunks are still saved. Cancellation behaves as in Fetch.
+func Backfill(ctx context.Context, sources Sources, assets []*Asset, since, until time.Time, chunkYears int, sink Sink) []*AssetResult {
+	limit := ratelimit.New(viper.GetInt("fred_rate_limit"))
+
+	if chunkYears <= 0 {
+		chunkYears = 1
+	}
+
+	results := make([]*AssetResult, len(assets))
+	emit, wait := stream(ctx, sink)
+	forEach(ctx, len(assets), numWorkers(), func(idx int) {
+		asset := assets[idx]
+		result := &AssetResult{Asset: asset}
+		results[idx] = result
+		defer emit(idx, result)
+
+		subLog := log.With().Str("Ticker", asset.Ticker).Logger()
+		src, err := sources.For(asset)
+		if err != nil {
+			subLog.Error().Err(err).Msg("cannot backfill asset")
+			result.Err = err
+			return
+		}
+
+		freq, err := downloadFrequency(ctx, src, asset, limit)
+		if err != nil {
+			subLog.Error().Err(err).Msg("invalid frequency")
+			result.Err = err
+			return
+		}
+
+		start := backfillStart(asset, since)
+		subLog.Info().Time("Since", start).Time("Until", until).Stringer("Frequency", freq).Msg("backfilling asset")
+		reqCtx := context.WithoutCancel(ctx)
+
+		for chunkStart := start; !chunkStart.After(until); chunkStart = chunkStart.AddDate(chunkYears, 0, 0) {
+			chunkEnd := chunkStart.AddDate(chunkYears, 0, -1)
+			if chunkEnd.After(until) {
+				chunkEnd = until
+			}
+
+			var observations, vintages []*Observation
+			retries, err := withRetry(ctx, asset.Ticker, func() (err error) {
+				limit.Take()
+				observations, vintages, err = download(reqCtx, src, asset.Ticker, chunkStart, chunkEnd, freq)
+				return
+			})
+			result.Retries += retries
+			if err != nil {
+				subLog.Error().Err(err).Time("ChunkStart", chunkStart).Time("ChunkEnd", chunkEnd).Msg("error when requesting eod quote")
+				if result.Err == nil {
+					result.Err = err
 				}
-				quotes = append(quotes, &q)
+				continue
 			}
+
+			subLog.Debug().Time("ChunkStart", chunkStart).Time("ChunkEnd", chunkEnd).Int("NumObservations", len(observations)).Msg("downloaded chunk")
+			emit(idx, &AssetResult{
+				Asset:    asset,
+				Quotes:   observationsToEod(src, asset, freq, observations),
+				Vintages: observationsToVintages(src, asset, vintages),
+				Partial:  true,
+			})
+		}
+	})
+	wait()
+
+	return fillCanceled(ctx, assets, results)
+}
+
+// fillCanceled records a canceled result for each asset that was not
+// started before ctx was done
+func fillCanceled(ctx context.Context, assets []*Asset, results []*AssetResult) []*AssetResult {
+	for idx, result := range results {
+		if result == nil {
+			results[idx] = &AssetResult{Asset: assets[idx], Err: ctx.Err()}
 		}
 	}
+	return results
+}
 
+func observationsToEod(src Source, asset *Asset, freq Frequency, observations []*Observation) []*Eod {
+	quotes := make([]*Eod, 0, len(observations))
+	for _, obs := range observations {
+		quotes = append(quotes, &Eod{
+			Date:          obs.Date.Format("2006-01-02"),
+			Ticker:        asset.Ticker,
+			Exchange:      src.Exchange(),
+			AssetType:     asset.AssetType,
+			CompositeFigi: asset.CompositeFigi,
+			Open:          obs.Value,
+			High:          obs.Value,
+			Low:           obs.Value,
+			Close:         obs.Value,
+			Split:         1,
+			Frequency:     freq.String(),
+			Source:        src.Label(),
+		})
+	}
 	return quotes
 }
@@ -0,0 +1,143 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fred
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.uber.org/ratelimit"
+)
+
+func TestFetchStart(t *testing.T) {
+	lastDate := time.Date(2022, 3, 31, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		lastDate time.Time
+		overlap  time.Duration
+		want     time.Time
+	}{
+		{"no stored observations", time.Time{}, 30 * 24 * time.Hour, FullHistoryStart},
+		{"no stored observations without overlap", time.Time{}, 0, FullHistoryStart},
+		{"no overlap", lastDate, 0, lastDate},
+		{"overlap", lastDate, 30 * 24 * time.Hour, time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{"overlap across years", lastDate, 365 * 24 * time.Hour, time.Date(2021, 3, 31, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			asset := &Asset{Ticker: "DGS10", LastDate: tt.lastDate}
+			if got := fetchStart(asset, tt.overlap); !got.Equal(tt.want) {
+				t.Errorf("fetchStart() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackfillStart(t *testing.T) {
+	since := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	first := time.Date(2010, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name             string
+		observationStart time.Time
+		since            time.Time
+		want             time.Time
+	}{
+		{"first observation unknown", time.Time{}, since, since},
+		{"full history with unknown first observation", time.Time{}, FullHistoryStart, FullHistoryStart},
+		{"full history", first, FullHistoryStart, first},
+		{"since before first observation", first, since, first},
+		{"since after first observation", since, first, first},
+		{"since on first observation", first, first, first},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			asset := &Asset{Ticker: "DGS10", ObservationStart: tt.observationStart}
+			if got := backfillStart(asset, tt.since); !got.Equal(tt.want) {
+				t.Errorf("backfillStart() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// describeSource is a Source that only describes series
+type describeSource struct {
+	Source
+	series      *Series
+	err         error
+	numDescribe int
+}
+
+func (s *describeSource) DescribeSeries(ctx context.Context, seriesID string) (*Series, error) {
+	s.numDescribe++
+	return s.series, s.err
+}
+
+func TestDownloadFrequency(t *testing.T) {
+	monthly := &Series{ID: "UNRATE", FrequencyShort: "M"}
+	daily := &Series{ID: "DGS10", FrequencyShort: "D"}
+
+	tests := []struct {
+		name         string
+		spec         string
+		native       string
+		series       *Series
+		describe     *Series
+		describeErr  error
+		want         Frequency
+		wantDescribe int
+	}{
+		{"native configured", FrequencyNative, "", nil, monthly, nil, NativeFrequency, 0},
+		{"native known", FrequencyDaily, "M", nil, monthly, nil, NativeFrequency, 0},
+		{"series described", FrequencyDaily, "", monthly, monthly, nil, NativeFrequency, 0},
+		{"unknown native lower than configured", FrequencyDaily, "", nil, monthly, nil, NativeFrequency, 1},
+		{"unknown native higher than configured", FrequencyMonthly, "", nil, daily, nil, Frequency{Period: FrequencyMonthly, Aggregation: AggregationAverage}, 1},
+		{"unknown native cannot be described", FrequencyDaily, "", nil, nil, ErrNotSupported, NativeFrequency, 1},
+	}
+
+	viper.Set("retry.max_retries", 0)
+	t.Cleanup(func() {
+		viper.Set("frequency.default", nil)
+		viper.Set("retry.max_retries", nil)
+	})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			viper.Set("frequency.default", tt.spec)
+			src := &describeSource{series: tt.describe, err: tt.describeErr}
+			asset := &Asset{Ticker: "UNRATE", NativeFrequency: tt.native, Series: tt.series}
+
+			got, err := downloadFrequency(context.Background(), src, asset, ratelimit.NewUnlimited())
+			if err != nil {
+				t.Fatalf("downloadFrequency() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("downloadFrequency() = %v, want %v", got, tt.want)
+			}
+			if src.numDescribe != tt.wantDescribe {
+				t.Errorf("described series %d times, want %d", src.numDescribe, tt.wantDescribe)
+			}
+			if tt.describe != nil && tt.wantDescribe > 0 && asset.Series != tt.describe {
+				t.Error("downloadFrequency() did not keep the described series on the asset")
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fred
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// exportAssetsQuery selects the same columns as assetsQuery without reading
+// series_metadata, which only exists once the schema has been migrated.
+// Inactive assets are included.
+const exportAssetsQuery = `SELECT
+	composite_figi,
+	ticker,
+	asset_type,
+	NULL::date AS last_date,
+	NULL::text AS native_frequency,
+	NULL::date AS observation_start
+FROM assets WHERE asset_type = ANY($1)`
+
+// exportQuery selects the stored quotes of an asset; %s is the frequency
+// column, or NULL when the eod table has not been migrated
+const exportQuery = `SELECT event_date, open, high, low, close, volume, dividend, split_factor, source, %s
+FROM eod WHERE composite_figi = $1 AND event_date >= $2::date AND event_date <= $3::date`
+
+// ExportOptions selects the stored quotes written by Export
+type ExportOptions struct {
+	// Since and Until bound the event dates that are exported (inclusive);
+	// a zero Until exports through today
+	Since time.Time
+	Until time.Time
+
+	// IncludeFilled exports the quotes forward-filled on trading days
+	// without an observation (source api.pennyvault.com) as well
+	IncludeFilled bool
+
+	// AsOf exports the values as they were published on that date from
+	// the eod_vintage table instead of the current quotes; only series
+	// downloaded in vintage mode have any
+	AsOf time.Time
+}
+
+// LoadExportAssets returns the active assets of the given asset types, or
+// the assets with the given tickers when tickers is not empty. Tickers
+// that are named explicitly are exported even when they have been
+// deactivated (e.g. by prune) so that their stored history can still be
+// archived. Like Export it only reads the assets table and works with a
+// read-only role.
+func LoadExportAssets(ctx context.Context, assetTypes []string, tickers []string) []*Asset {
+	if len(tickers) > 0 {
+		return loadAssetsByTicker(ctx, exportAssetsQuery, assetTypes, tickers)
+	}
+	return loadAssets(ctx, exportAssetsQuery+` AND active = 't'`, assetTypes)
+}
+
+// Export reads the stored quotes of each asset from the eod table and
+// writes them to sink one asset at a time. Quotes are labeled with the
+// exchange of the source that handles the asset type, derived series with
+// ExchangeDerived and any other asset with FRED. It returns the number of
+// quotes exported.
+//
+// When opts.AsOf is set the values as published on that date are read
+// from eod_vintage instead; IncludeFilled has no effect because vintages
+// are never forward-filled.
+//
+// Export does not change the schema; when the eod table predates the
+// frequency column the quotes are exported without a frequency.
+func Export(ctx context.Context, sources Sources, assets []*Asset, opts ExportOptions, sink Sink) (int, error) {
+	conn, err := pgx.Connect(ctx, viper.GetString("database.url"))
+	if err != nil {
+		log.Error().Err(err).Msg("Could not connect to database")
+		return 0, err
+	}
+	defer conn.Close(ctx)
+
+	hasFrequency, err := columnExists(ctx, conn, "eod", "frequency")
+	if err != nil {
+		log.Error().Err(err).Msg("could not inspect eod table")
+		return 0, err
+	}
+
+	frequency := "frequency"
+	if !hasFrequency {
+		log.Warn().Msg("eod table has no frequency column; exporting quotes without a frequency")
+		frequency = "NULL::text"
+	}
+
+	until := opts.Until
+	if until.IsZero() {
+		until = time.Now()
+	}
+
+	query := fmt.Sprintf(exportQuery, frequency)
+	if !opts.IncludeFilled {
+		query += ` AND source IS DISTINCT FROM 'api.pennyvault.com'`
+	}
+	query += ` ORDER BY event_date ASC`
+
+	total := 0
+	for _, asset := range assets {
+		if ctx.Err() != nil {
+			return total, ctx.Err()
+		}
+
+		exchange := ExchangeFRED
+		if src, err := sources.For(asset); err == nil {
+			exchange = src.Exchange()
+		} else if asset.AssetType == AssetTypeDerived {
+			exchange = ExchangeDerived
+		}
+
+		var quotes []*Eod
+		if opts.AsOf.IsZero() {
+			quotes, err = exportQuotes(ctx, conn, query, asset, exchange, opts.Since, until)
+		} else {
+			quotes, err = AsKnownOn(ctx, conn, asset, opts.Since, until, opts.AsOf)
+		}
+		if err != nil {
+			log.Error().Err(err).Str("Ticker", asset.Ticker).Msg("could not read stored quotes")
+			return total, err
+		}
+
+		if err = sink.Write(ctx, &AssetResult{Asset: asset, Quotes: quotes}); err != nil {
+			log.Error().Err(err).Str("Ticker", asset.Ticker).Msg("could not export asset")
+			return total, err
+		}
+
+		log.Info().Str("Ticker", asset.Ticker).Int("NumQuotes", len(quotes)).Msg("exported asset")
+		total += len(quotes)
+	}
+
+	return total, nil
+}
+
+// exportQuotes reads the quotes of asset selected by query
+func exportQuotes(ctx context.Context, conn *pgx.Conn, query string, asset *Asset, exchange string, since, until time.Time) ([]*Eod, error) {
+	rows, err := conn.Query(ctx, query, asset.CompositeFigi, since, until)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	quotes := make([]*Eod, 0, 252)
+	for rows.Next() {
+		var eventDate time.Time
+		var source, frequency *string
+		quote := &Eod{
+			Ticker:        asset.Ticker,
+			Exchange:      exchange,
+			AssetType:     asset.AssetType,
+			CompositeFigi: asset.CompositeFigi,
+		}
+
+		err = rows.Scan(&eventDate, &quote.Open, &quote.High, &quote.Low, &quote.Close, &quote.Volume, &quote.Dividend, &quote.Split, &source, &frequency)
+		if err != nil {
+			return nil, err
+		}
+
+		quote.Date = eventDate.Format("2006-01-02")
+		if source != nil {
+			quote.Source = *source
+		}
+		if frequency != nil {
+			quote.Frequency = *frequency
+		}
+		quotes = append(quotes, quote)
+	}
+
+	return quotes, rows.Err()
+}
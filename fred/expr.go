@@ -0,0 +1,246 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fred
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"unicode"
+)
+
+var ErrInvalidExpression = errors.New("invalid expression")
+
+// Expression is an arithmetic expression over tickers, e.g.
+// `(DGS10 - DGS3MO) / 100`. It supports + - * /, unary minus, parentheses
+// and numeric constants. Tickers may include a units transformation, e.g.
+// CPIAUCSL:pc1.
+type Expression struct {
+	source string
+	root   exprNode
+}
+
+type exprNode interface {
+	eval(values map[string]float64) float64
+}
+
+type numberNode float64
+
+func (n numberNode) eval(map[string]float64) float64 { return float64(n) }
+
+type tickerNode string
+
+func (n tickerNode) eval(values map[string]float64) float64 { return values[string(n)] }
+
+type negateNode struct{ operand exprNode }
+
+func (n negateNode) eval(values map[string]float64) float64 { return -n.operand.eval(values) }
+
+type binaryNode struct {
+	op          byte
+	left, right exprNode
+}
+
+func (n binaryNode) eval(values map[string]float64) float64 {
+	left, right := n.left.eval(values), n.right.eval(values)
+	switch n.op {
+	case '+':
+		return left + right
+	case '-':
+		return left - right
+	case '*':
+		return left * right
+	default:
+		return left / right
+	}
+}
+
+// ParseExpression parses an arithmetic expression over tickers
+func ParseExpression(source string) (*Expression, error) {
+	p := &exprParser{input: source}
+	root, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+
+	p.skipSpace()
+	if p.pos < len(p.input) {
+		return nil, p.errorf("unexpected %q", p.input[p.pos])
+	}
+
+	return &Expression{source: source, root: root}, nil
+}
+
+func (e *Expression) String() string {
+	return e.source
+}
+
+// Tickers returns the sorted, distinct tickers referenced by the
+// expression
+func (e *Expression) Tickers() []string {
+	seen := make(map[string]bool)
+	var walk func(exprNode)
+	walk = func(node exprNode) {
+		switch n := node.(type) {
+		case tickerNode:
+			seen[string(n)] = true
+		case negateNode:
+			walk(n.operand)
+		case binaryNode:
+			walk(n.left)
+			walk(n.right)
+		}
+	}
+	walk(e.root)
+
+	tickers := make([]string, 0, len(seen))
+	for ticker := range seen {
+		tickers = append(tickers, ticker)
+	}
+	sort.Strings(tickers)
+	return tickers
+}
+
+// Eval computes the expression with the given ticker values. Every ticker
+// returned by Tickers must be present in values.
+func (e *Expression) Eval(values map[string]float64) float64 {
+	return e.root.eval(values)
+}
+
+type exprParser struct {
+	input string
+	pos   int
+}
+
+func (p *exprParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s at offset %d in %q", ErrInvalidExpression, fmt.Sprintf(format, args...), p.pos, p.input)
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.input) && unicode.IsSpace(rune(p.input[p.pos])) {
+		p.pos++
+	}
+}
+
+// peek returns the next non-space character or 0 at the end of input
+func (p *exprParser) peek() byte {
+	p.skipSpace()
+	if p.pos >= len(p.input) {
+		return 0
+	}
+	return p.input[p.pos]
+}
+
+// parseSum parses term (('+' | '-') term)*
+func (p *exprParser) parseSum() (exprNode, error) {
+	left, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+
+	for op := p.peek(); op == '+' || op == '-'; op = p.peek() {
+		p.pos++
+		right, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op: op, left: left, right: right}
+	}
+
+	return left, nil
+}
+
+// parseProduct parses unary (('*' | '/') unary)*
+func (p *exprParser) parseProduct() (exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for op := p.peek(); op == '*' || op == '/'; op = p.peek() {
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op: op, left: left, right: right}
+	}
+
+	return left, nil
+}
+
+// parseUnary parses '-' unary | primary
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.peek() == '-' {
+		p.pos++
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return negateNode{operand: operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+// parsePrimary parses a number, a ticker or a parenthesized expression
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	ch := p.peek()
+	start := p.pos
+
+	switch {
+	case ch == 0:
+		return nil, p.errorf("unexpected end of expression")
+	case ch == '(':
+		p.pos++
+		node, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, p.errorf("expected )")
+		}
+		p.pos++
+		return node, nil
+	case ch == '.' || (ch >= '0' && ch <= '9'):
+		for p.pos < len(p.input) && (p.input[p.pos] == '.' || (p.input[p.pos] >= '0' && p.input[p.pos] <= '9')) {
+			p.pos++
+		}
+		text := p.input[start:p.pos]
+		val, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			p.pos = start
+			return nil, p.errorf("invalid number %q", text)
+		}
+		return numberNode(val), nil
+	case unicode.IsLetter(rune(ch)):
+		for p.pos < len(p.input) && isTickerChar(p.input[p.pos]) {
+			p.pos++
+		}
+		ticker, err := CanonicalTicker(p.input[start:p.pos])
+		if err != nil {
+			p.pos = start
+			return nil, p.errorf("%s", err.Error())
+		}
+		return tickerNode(ticker), nil
+	default:
+		return nil, p.errorf("unexpected %q", ch)
+	}
+}
+
+func isTickerChar(ch byte) bool {
+	return ch == '_' || ch == ':' || (ch >= '0' && ch <= '9') || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z')
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fred
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseExpression(t *testing.T) {
+	values := map[string]float64{
+		"DGS10":        4.5,
+		"DGS3MO":       5.25,
+		"CPIAUCSL:pc1": 3.2,
+	}
+
+	tests := []struct {
+		source  string
+		tickers []string
+		want    float64
+	}{
+		{"1 + 2 * 3", []string{}, 7},
+		{"(1 + 2) * 3", []string{}, 9},
+		{"10 - 4 - 3", []string{}, 3},
+		{"8 / 4 / 2", []string{}, 1},
+		{"2 * 3 + 4 * 5", []string{}, 26},
+		{"-2 * 3", []string{}, -6},
+		{"2 * -3", []string{}, -6},
+		{"--2", []string{}, 2},
+		{"-(1 + 2)", []string{}, -3},
+		{".5 + 1.25", []string{}, 1.75},
+		{"DGS10 - DGS3MO", []string{"DGS10", "DGS3MO"}, -0.75},
+		{"(dgs10 - DGS3MO) * 100", []string{"DGS10", "DGS3MO"}, -75},
+		{"-DGS10 + DGS10 * 2", []string{"DGS10"}, 4.5},
+		{"cpiaucsl:PC1 - DGS10", []string{"CPIAUCSL:pc1", "DGS10"}, -1.3},
+		{"CPIAUCSL:lin", []string{"CPIAUCSL"}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			expr, err := ParseExpression(tt.source)
+			if err != nil {
+				t.Fatalf("ParseExpression(%q) error = %v", tt.source, err)
+			}
+
+			if got := expr.Tickers(); !reflect.DeepEqual(got, tt.tickers) {
+				t.Errorf("Tickers() = %v, want %v", got, tt.tickers)
+			}
+			if got := expr.Eval(values); got-tt.want > 1e-9 || tt.want-got > 1e-9 {
+				t.Errorf("Eval() = %v, want %v", got, tt.want)
+			}
+			if expr.String() != tt.source {
+				t.Errorf("String() = %q, want %q", expr.String(), tt.source)
+			}
+		})
+	}
+}
+
+func TestParseExpressionErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		err    error
+	}{
+		{"", ErrInvalidExpression},
+		{"   ", ErrInvalidExpression},
+		{"1 +", ErrInvalidExpression},
+		{"(1 + 2", ErrInvalidExpression},
+		{"1 + 2)", ErrInvalidExpression},
+		{"1 2", ErrInvalidExpression},
+		{"DGS10 DGS3MO", ErrInvalidExpression},
+		{"1..2", ErrInvalidExpression},
+		{"DGS10 % 2", ErrInvalidExpression},
+		{"* 2", ErrInvalidExpression},
+		{"DGS10:bogus", ErrInvalidExpression},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			expr, err := ParseExpression(tt.source)
+			if err == nil {
+				t.Fatalf("ParseExpression(%q) = %v, want error", tt.source, expr)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("ParseExpression(%q) error = %v, want %v", tt.source, err, tt.err)
+			}
+		})
+	}
+}
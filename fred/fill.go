@@ -17,6 +17,7 @@ package fred
 
 import (
 	"context"
+	"errors"
 	"time"
 
 	"github.com/jackc/pgx/v4"
@@ -24,13 +25,37 @@ import (
 	"github.com/spf13/viper"
 )
 
-// Fill checks that all trading days have a value for the given
-// FRED ticker. If a point is missing the previous point is propgated
-// forward.
-func Fill(asset *Asset) error {
+// Fill checks that all trading days within max_age_forward_fill have a
+// value for the given FRED ticker. Missing points are filled with the
+// asset's fill strategy.
+func Fill(ctx context.Context, asset *Asset) error {
+	maxAge := viper.GetDuration("max_age_forward_fill")
+	return FillSince(ctx, asset, time.Now().Add(maxAge*-1))
+}
+
+// FillSince checks that all trading days on or after since have a value
+// for the given FRED ticker. Missing points are filled with the asset's
+// fill strategy (see FillStrategyFor).
+//
+// Existing observations and trading days are each loaded with a single
+// query, gaps are computed in memory and all fill rows are copied into eod
+// at once. All reads and writes happen inside one transaction.
+func FillSince(ctx context.Context, asset *Asset, since time.Time) error {
 	subLog := log.With().Str("figi", asset.CompositeFigi).Str("ticker", asset.Ticker).Logger()
 	subLog.Info().Msg("checking for missing values")
-	ctx := context.Background()
+
+	strategy, err := FillStrategyFor(asset)
+	if err != nil {
+		subLog.Error().Err(err).Msg("invalid fill strategy")
+		return err
+	}
+
+	freq, err := FrequencyFor(asset)
+	if err != nil {
+		subLog.Error().Err(err).Msg("invalid frequency")
+		return err
+	}
+
 	conn, err := pgx.Connect(ctx, viper.GetString("database.url"))
 	if err != nil {
 		subLog.Error().Err(err).Msg("Could not connect to database")
@@ -38,114 +63,131 @@ func Fill(asset *Asset) error {
 	}
 	defer conn.Close(ctx)
 
-	// get since date
-	var since time.Time
-	if err = conn.QueryRow(ctx, "SELECT event_date FROM eod WHERE composite_figi=$1 ORDER BY event_date ASC LIMIT 1", asset.CompositeFigi).Scan(&since); err != nil {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		subLog.Error().Err(err).Msg("could not begin transaction")
+		return err
+	}
+	defer func() {
+		// no-op once the transaction has been committed
+		_ = tx.Rollback(context.WithoutCancel(ctx))
+	}()
+
+	// never fill before the first stored observation
+	var firstDate time.Time
+	if err = tx.QueryRow(ctx, "SELECT event_date FROM eod WHERE composite_figi=$1 ORDER BY event_date ASC LIMIT 1", asset.CompositeFigi).Scan(&firstDate); err != nil {
 		subLog.Error().Err(err).Msg("could not retrieve first date")
 		return err
 	}
 
-	max_age := viper.GetDuration("max_age_forward_fill")
-	max_age_dt := time.Now().Add(max_age * -1)
-	if max_age_dt.After(since) {
-		since = max_age_dt
+	if firstDate.After(since) {
+		since = firstDate
 	}
 
-	subLog.Info().Time("Since", since).Msg("first date for forward-fill")
-
-	// initialize prevValue
-	var prevValue float64
-	if err = conn.QueryRow(ctx, "SELECT close FROM eod WHERE composite_figi=$1 AND event_date < $2 ORDER BY event_date DESC LIMIT 1", asset.CompositeFigi, since).Scan(&prevValue); err != nil {
+	subLog.Info().Time("Since", since).Str("Strategy", strategy.Name()).Msg("first date for fill")
+
+	// latest true observation before the fill window; trading days are
+	// loaded from this date so staleness is counted from it
+	var prev *Observation
+	tradingDaysSince := since
+	var prevObs Observation
+	err = tx.QueryRow(ctx, "SELECT event_date, close FROM eod WHERE composite_figi=$1 AND event_date < $2 AND source IS DISTINCT FROM 'api.pennyvault.com' ORDER BY event_date DESC LIMIT 1", asset.CompositeFigi, since).Scan(&prevObs.Date, &prevObs.Value)
+	switch {
+	case err == nil:
+		prev = &prevObs
+		tradingDaysSince = prevObs.Date
+	case !errors.Is(err, pgx.ErrNoRows):
 		subLog.Error().Err(err).Msg("could not retrieve first value")
 		return err
 	}
 
-	// create a new transaction for inserts
-	tx, err := conn.Begin(ctx)
-	if err != nil {
-		subLog.Error().Err(err).Msg("could not begin transaction")
-		return err
-	}
-
 	// remove fill values in the since period (in-case additional values were published by the true source)
 	if _, err = tx.Exec(ctx, `DELETE FROM eod WHERE composite_figi = $1 AND event_date >= $2 AND source = 'api.pennyvault.com'`, asset.CompositeFigi, since); err != nil {
 		subLog.Error().Err(err).Msg("could not remove old values entered by penny vault")
-		check(tx.Rollback(ctx), "transaction rollback failed")
+		return err
+	}
+
+	observations, err := queryObservations(ctx, tx, "SELECT event_date, close FROM eod WHERE composite_figi=$1 AND event_date >= $2 ORDER BY event_date ASC", asset.CompositeFigi, since)
+	if err != nil {
+		subLog.Error().Err(err).Msg("could not load observations")
 		return err
 	}
 
 	// get a list of valid trading days
 	tradingDays := make([]time.Time, 0, 252*50)
-	rows, err := conn.Query(ctx, "SELECT trading_day FROM trading_days WHERE trading_day >= $1 ORDER BY trading_day ASC", since)
+	rows, err := tx.Query(ctx, "SELECT trading_day FROM trading_days WHERE trading_day >= $1 ORDER BY trading_day ASC", tradingDaysSince)
 	if err != nil {
 		subLog.Error().Err(err).Msg("query database for trading days failed")
-		check(tx.Rollback(ctx), "rollback failed")
 		return err
 	}
 
 	for rows.Next() {
 		var dt time.Time
-		err = rows.Scan(&dt)
-		if err != nil {
+		if err = rows.Scan(&dt); err != nil {
 			subLog.Error().Err(err).Msg("could not scan date value")
-			check(tx.Rollback(ctx), "rollback failed")
+			rows.Close()
 			return err
 		}
 		tradingDays = append(tradingDays, dt)
 	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		subLog.Error().Err(err).Msg("query database for trading days failed")
+		return err
+	}
+
+	// fills before the window were created by earlier runs and were not
+	// removed above
+	fills := make([]*Observation, 0)
+	for _, fill := range strategy.Fill(tradingDays, observations, prev) {
+		if fill.Date.Before(since) {
+			continue
+		}
+		subLog.Debug().Time("EventDate", fill.Date).Float64("Value", fill.Value).Msg("missing value in history")
+		fills = append(fills, fill)
+	}
 
-	for _, dt := range tradingDays {
-		// check if missing val
-		cnt := 0
-		err = conn.QueryRow(ctx, "SELECT count(*) FROM eod WHERE composite_figi=$1 AND event_date=$2", asset.CompositeFigi, dt).Scan(&cnt)
+	if len(fills) > 0 {
+		_, err = tx.CopyFrom(ctx, pgx.Identifier{"eod"}, eodColumns, pgx.CopyFromSlice(len(fills), func(idx int) ([]interface{}, error) {
+			val := fills[idx].Value
+			return []interface{}{asset.Ticker, asset.CompositeFigi, fills[idx].Date, val, val, val, val, int64(0), float64(0), float64(1), "api.pennyvault.com", freq.String()}, nil
+		}))
 		if err != nil {
-			subLog.Error().Err(err).Time("EventDate", dt).Msg("could not determine count for given date")
-			check(tx.Rollback(ctx), "transaction rollback failed")
+			subLog.Error().Err(err).Msg("could not insert fill rows into database")
 			return err
 		}
+	}
 
-		if cnt != 1 {
-			// value is missing, fill forward
-			subLog.Info().Time("EventDate", dt).Float64("PrevValue", prevValue).Msg("missing value in history")
-			if _, err = tx.Exec(ctx, `INSERT INTO eod (
-				"ticker",
-				"composite_figi",
-				"event_date",
-				"open",
-				"high",
-				"low",
-				"close",
-				"volume",
-				"dividend",
-				"split_factor",
-				"source"
-			) VALUES (
-				$1,
-				$2,
-				$3,
-				$4,
-				$5,
-				$6,
-				$7,
-				$8,
-				$9,
-				$10,
-				$11
-			)`, asset.Ticker, asset.CompositeFigi, dt, prevValue, prevValue, prevValue, prevValue, 0, 0, 1, "api.pennyvault.com"); err != nil {
-				subLog.Error().Err(err).Msg("could not insert row into database")
-				check(tx.Rollback(ctx), "transaction rollback failed")
-				return err
-			}
-		} else {
-			// update forward-fill value
-			if err = conn.QueryRow(ctx, "SELECT close FROM eod WHERE composite_figi=$1 AND event_date = $2", asset.CompositeFigi, dt).Scan(&prevValue); err != nil {
-				subLog.Error().Err(err).Time("EventDate", dt).Msg("could not update fill-forward value")
-				check(tx.Rollback(ctx), "transaction rollback failed")
-				return err
-			}
-		}
+	if err = tx.Commit(ctx); err != nil {
+		subLog.Error().Err(err).Msg("transaction commit failed")
+		return err
 	}
 
-	check(tx.Commit(ctx), "transaction commit failed")
+	subLog.Info().Int("NumFilled", len(fills)).Msg("fill finished")
 	return nil
 }
+
+// querier is implemented by both *pgx.Conn and pgx.Tx
+type querier interface {
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+}
+
+// queryObservations returns the (event_date, close) rows selected by query
+func queryObservations(ctx context.Context, db querier, query string, args ...interface{}) ([]*Observation, error) {
+	rows, err := db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	observations := make([]*Observation, 0, 252)
+	for rows.Next() {
+		obs := &Observation{}
+		if err = rows.Scan(&obs.Date, &obs.Value); err != nil {
+			return nil, err
+		}
+		observations = append(observations, obs)
+	}
+
+	return observations, rows.Err()
+}
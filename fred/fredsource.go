@@ -0,0 +1,118 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fred
+
+import (
+	"context"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	SourceFRED    = "fred"
+	AssetTypeFRED = "FRED"
+	ExchangeFRED  = "FRED"
+	LabelFRED     = "fred.stlouisfed.org"
+)
+
+// FREDSource serves economic indicators published by the St. Louis Fed
+type FREDSource struct {
+	client Client
+
+	// api is used for series metadata and search; it is nil when no api
+	// key is configured
+	api *APIClient
+}
+
+// NewFREDSource creates a source that downloads observations with client
+// and retrieves series metadata with api. api may be nil.
+func NewFREDSource(client Client, api *APIClient) *FREDSource {
+	return &FREDSource{
+		client: client,
+		api:    api,
+	}
+}
+
+// NewFREDSourceFromConfig creates a FRED source using the client selected
+// by NewClientFromConfig
+func NewFREDSourceFromConfig() (Source, error) {
+	client, err := NewClientFromConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	var api *APIClient
+	if apiClient, ok := client.(*APIClient); ok {
+		api = apiClient
+	} else if apiKey := viper.GetString("fred.api_key"); apiKey != "" {
+		api = NewAPIClient(apiKey)
+	}
+
+	return NewFREDSource(client, api), nil
+}
+
+func (f *FREDSource) Name() string      { return SourceFRED }
+func (f *FREDSource) AssetType() string { return AssetTypeFRED }
+func (f *FREDSource) Exchange() string  { return ExchangeFRED }
+func (f *FREDSource) Label() string     { return LabelFRED }
+
+func (f *FREDSource) ListSeries(ctx context.Context, filter SeriesFilter) ([]*Series, error) {
+	if f.api == nil {
+		return nil, ErrMissingAPIKey
+	}
+	return f.api.Search(ctx, filter)
+}
+
+func (f *FREDSource) Observations(ctx context.Context, seriesID string, start, end time.Time, freq Frequency) ([]*Observation, error) {
+	return f.client.Observations(ctx, seriesID, start, end, freq)
+}
+
+// Vintages retrieves ALFRED real-time periods; it requires an api key
+func (f *FREDSource) Vintages(ctx context.Context, seriesID string, start, end time.Time, freq Frequency) ([]*Observation, error) {
+	if f.api == nil {
+		return nil, ErrMissingAPIKey
+	}
+	return f.api.Vintages(ctx, seriesID, start, end, freq)
+}
+
+// VintagesAvailable reports ErrMissingAPIKey when no api key is configured
+func (f *FREDSource) VintagesAvailable() error {
+	if f.api == nil {
+		return ErrMissingAPIKey
+	}
+	return nil
+}
+
+// DescribeSeries returns the metadata of a series. Derived tickers such as
+// CPIAUCSL:pc1 are described by their underlying series with the units
+// transformation recorded.
+func (f *FREDSource) DescribeSeries(ctx context.Context, seriesID string) (*Series, error) {
+	if f.api == nil {
+		return nil, ErrMissingAPIKey
+	}
+
+	id, units, err := SplitTicker(seriesID)
+	if err != nil {
+		return nil, err
+	}
+
+	series, err := f.api.Series(ctx, id)
+	if err != nil || units == "" {
+		return series, err
+	}
+	return transformSeries(series, units), nil
+}
@@ -0,0 +1,172 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fred
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+const (
+	FrequencyNative     = "native"
+	FrequencyDaily      = "daily"
+	FrequencyWeekly     = "weekly"
+	FrequencyBiweekly   = "biweekly"
+	FrequencyMonthly    = "monthly"
+	FrequencyQuarterly  = "quarterly"
+	FrequencySemiannual = "semiannual"
+	FrequencyAnnual     = "annual"
+)
+
+const (
+	AggregationAverage     = "avg"
+	AggregationSum         = "sum"
+	AggregationEndOfPeriod = "eop"
+)
+
+var (
+	ErrUnknownFrequency   = errors.New("unknown frequency")
+	ErrUnknownAggregation = errors.New("unknown aggregation method")
+)
+
+// frequencyOrder lists the supported periods from the highest to the
+// lowest frequency
+var frequencyOrder = []string{
+	FrequencyDaily,
+	FrequencyWeekly,
+	FrequencyBiweekly,
+	FrequencyMonthly,
+	FrequencyQuarterly,
+	FrequencySemiannual,
+	FrequencyAnnual,
+}
+
+// frequencyShort maps each period to the frequency_short value used by
+// FRED, which is also the `frequency` parameter of the API
+var frequencyShort = map[string]string{
+	FrequencyDaily:      "D",
+	FrequencyWeekly:     "W",
+	FrequencyBiweekly:   "BW",
+	FrequencyMonthly:    "M",
+	FrequencyQuarterly:  "Q",
+	FrequencySemiannual: "SA",
+	FrequencyAnnual:     "A",
+}
+
+// graphFrequency maps each period to the `fq` parameter of fredgraph.csv
+var graphFrequency = map[string]string{
+	FrequencyDaily:      "Daily",
+	FrequencyWeekly:     "Weekly, Ending Friday",
+	FrequencyBiweekly:   "Biweekly, Ending Wednesday",
+	FrequencyMonthly:    "Monthly",
+	FrequencyQuarterly:  "Quarterly",
+	FrequencySemiannual: "Semiannual",
+	FrequencyAnnual:     "Annual",
+}
+
+// Frequency selects the period of the observations requested from a
+// source and how observations of a higher native frequency are aggregated
+// into it
+type Frequency struct {
+	Period      string
+	Aggregation string
+}
+
+// NativeFrequency requests observations as published by the source
+var NativeFrequency = Frequency{Period: FrequencyNative}
+
+// IsNative reports whether observations are requested without conversion
+func (f Frequency) IsNative() bool {
+	return f.Period == FrequencyNative || f.Period == ""
+}
+
+// String formats the frequency as accepted by ParseFrequency. It is the
+// value recorded in eod.frequency.
+func (f Frequency) String() string {
+	if f.IsNative() {
+		return FrequencyNative
+	}
+	return f.Period + ":" + f.Aggregation
+}
+
+// ParseFrequency parses a frequency specification of the form
+// `period[:aggregation]`, e.g. `monthly:eop`. The aggregation defaults to
+// avg.
+func ParseFrequency(spec string) (Frequency, error) {
+	period, aggregation, _ := strings.Cut(strings.ToLower(strings.TrimSpace(spec)), ":")
+
+	if period == "" || period == FrequencyNative {
+		return NativeFrequency, nil
+	}
+	if _, ok := frequencyShort[period]; !ok {
+		return Frequency{}, fmt.Errorf("%w: %s", ErrUnknownFrequency, period)
+	}
+
+	switch aggregation {
+	case "":
+		aggregation = AggregationAverage
+	case AggregationAverage, AggregationSum, AggregationEndOfPeriod:
+	default:
+		return Frequency{}, fmt.Errorf("%w: %s", ErrUnknownAggregation, aggregation)
+	}
+
+	return Frequency{Period: period, Aggregation: aggregation}, nil
+}
+
+// frequencyRank returns the position of a FRED frequency_short value in
+// frequencyOrder or -1 if it is unknown
+func frequencyRank(short string) int {
+	for idx, period := range frequencyOrder {
+		if frequencyShort[period] == strings.ToUpper(short) {
+			return idx
+		}
+	}
+	return -1
+}
+
+// FrequencyFor returns the frequency configured for the asset in
+// `frequency.series.<ticker>`, falling back to `frequency.default`. FRED
+// can only aggregate to a lower frequency; when the asset's native
+// frequency is known and is lower than the configured one the series is
+// requested at its native frequency instead.
+func FrequencyFor(asset *Asset) (Frequency, error) {
+	spec := viper.GetString("frequency.default")
+	if override := viper.GetStringMapString("frequency.series")[strings.ToLower(asset.Ticker)]; override != "" {
+		spec = override
+	}
+
+	freq, err := ParseFrequency(spec)
+	if err != nil || freq.IsNative() {
+		return freq, err
+	}
+
+	native := asset.NativeFrequency
+	if asset.Series != nil && asset.Series.FrequencyShort != "" {
+		native = asset.Series.FrequencyShort
+	}
+
+	if nativeRank := frequencyRank(native); nativeRank > frequencyRank(frequencyShort[freq.Period]) {
+		log.Warn().Str("Ticker", asset.Ticker).Str("Frequency", freq.Period).Str("NativeFrequency", native).
+			Msg("series is not published at the requested frequency; using its native frequency")
+		return NativeFrequency, nil
+	}
+
+	return freq, nil
+}
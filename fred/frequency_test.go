@@ -0,0 +1,173 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fred
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestParseFrequency(t *testing.T) {
+	tests := []struct {
+		spec string
+		want Frequency
+		err  error
+	}{
+		{"", NativeFrequency, nil},
+		{"native", NativeFrequency, nil},
+		{" Native ", NativeFrequency, nil},
+		{"native:eop", NativeFrequency, nil},
+		{"daily", Frequency{FrequencyDaily, AggregationAverage}, nil},
+		{"monthly:eop", Frequency{FrequencyMonthly, AggregationEndOfPeriod}, nil},
+		{"Quarterly:SUM", Frequency{FrequencyQuarterly, AggregationSum}, nil},
+		{"annual:avg", Frequency{FrequencyAnnual, AggregationAverage}, nil},
+		{"weekly:", Frequency{FrequencyWeekly, AggregationAverage}, nil},
+		{"hourly", Frequency{}, ErrUnknownFrequency},
+		{"M", Frequency{}, ErrUnknownFrequency},
+		{":eop", NativeFrequency, nil},
+		{"monthly:median", Frequency{}, ErrUnknownAggregation},
+		{"monthly:eop:sum", Frequency{}, ErrUnknownAggregation},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := ParseFrequency(tt.spec)
+			if !errors.Is(err, tt.err) || (tt.err == nil && err != nil) {
+				t.Fatalf("ParseFrequency(%q) error = %v, want %v", tt.spec, err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("ParseFrequency(%q) = %+v, want %+v", tt.spec, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFrequencyFor(t *testing.T) {
+	tests := []struct {
+		name     string
+		def      string
+		series   map[string]string
+		native   string
+		metadata string
+		want     Frequency
+		err      error
+	}{
+		{
+			name: "native by default",
+			want: NativeFrequency,
+		},
+		{
+			name:   "aggregate a daily series to monthly",
+			def:    "monthly:eop",
+			native: "D",
+			want:   Frequency{FrequencyMonthly, AggregationEndOfPeriod},
+		},
+		{
+			name:   "same frequency as native",
+			def:    "monthly",
+			native: "M",
+			want:   Frequency{FrequencyMonthly, AggregationAverage},
+		},
+		{
+			name:   "native frequency lower than requested",
+			def:    "daily",
+			native: "M",
+			want:   NativeFrequency,
+		},
+		{
+			name:   "semiannual native lower than quarterly",
+			def:    "quarterly:sum",
+			native: "sa",
+			want:   NativeFrequency,
+		},
+		{
+			name:   "unknown native frequency",
+			def:    "weekly",
+			native: "WEF",
+			want:   Frequency{FrequencyWeekly, AggregationAverage},
+		},
+		{
+			name: "native frequency not loaded",
+			def:  "weekly",
+			want: Frequency{FrequencyWeekly, AggregationAverage},
+		},
+		{
+			name:     "metadata takes precedence over the stored native frequency",
+			def:      "weekly",
+			native:   "D",
+			metadata: "Q",
+			want:     NativeFrequency,
+		},
+		{
+			name:   "per series override",
+			def:    "monthly",
+			series: map[string]string{"dgs10": "annual:eop"},
+			native: "D",
+			want:   Frequency{FrequencyAnnual, AggregationEndOfPeriod},
+		},
+		{
+			name:   "per series native",
+			def:    "monthly",
+			series: map[string]string{"dgs10": "native"},
+			native: "D",
+			want:   NativeFrequency,
+		},
+		{
+			name:   "override of another series",
+			def:    "monthly",
+			series: map[string]string{"unrate": "annual"},
+			native: "D",
+			want:   Frequency{FrequencyMonthly, AggregationAverage},
+		},
+		{
+			name: "invalid default",
+			def:  "fortnightly",
+			err:  ErrUnknownFrequency,
+		},
+		{
+			name:   "invalid override",
+			series: map[string]string{"dgs10": "monthly:last"},
+			err:    ErrUnknownAggregation,
+		},
+	}
+
+	t.Cleanup(func() {
+		viper.Set("frequency.default", nil)
+		viper.Set("frequency.series", nil)
+	})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			viper.Set("frequency.default", tt.def)
+			viper.Set("frequency.series", tt.series)
+
+			asset := &Asset{Ticker: "DGS10", NativeFrequency: tt.native}
+			if tt.metadata != "" {
+				asset.Series = &Series{FrequencyShort: tt.metadata}
+			}
+
+			got, err := FrequencyFor(asset)
+			if !errors.Is(err, tt.err) || (tt.err == nil && err != nil) {
+				t.Fatalf("FrequencyFor() error = %v, want %v", err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("FrequencyFor() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fred
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/rs/zerolog/log"
+)
+
+const DefaultGraphBaseURL = "https://fred.stlouisfed.org/graph/fredgraph.csv"
+
+// GraphClient downloads observations from the fredgraph.csv export used by
+// the FRED website. It does not require an api key.
+type GraphClient struct {
+	BaseURL string
+
+	client *resty.Client
+}
+
+func NewGraphClient() *GraphClient {
+	return &GraphClient{
+		BaseURL: DefaultGraphBaseURL,
+		client:  resty.New(),
+	}
+}
+
+// Observations downloads the csv export for the given series and parses
+// each `date,value` line
+func (c *GraphClient) Observations(ctx context.Context, seriesID string, start, end time.Time, freq Frequency) ([]*Observation, error) {
+	id, units, err := SplitTicker(seriesID)
+	if err != nil {
+		return nil, err
+	}
+
+	params := map[string]string{
+		"mode": "fred",
+		"id":   id,
+		"cosd": start.Format("2006-01-02"),
+		"coed": end.Format("2006-01-02"),
+	}
+
+	if units != "" {
+		params["transformation"] = units
+	}
+
+	if !freq.IsNative() {
+		params["fq"] = graphFrequency[freq.Period]
+		params["fam"] = freq.Aggregation
+	}
+
+	log.Debug().Str("Url", c.BaseURL).Interface("Params", params).Msg("Loading URL")
+	resp, err := c.client.R().
+		SetContext(ctx).
+		SetHeader("Accept", "application/csv").
+		SetQueryParams(params).
+		Get(c.BaseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.IsError() {
+		return nil, &APIError{
+			StatusCode: resp.StatusCode(),
+			RetryAfter: parseRetryAfter(resp.Header().Get("Retry-After")),
+			Code:       resp.StatusCode(),
+			Message:    string(resp.Body()),
+		}
+	}
+
+	observations := make([]*Observation, 0)
+	lines := strings.Split(string(resp.Body()), "\n")
+	for _, ll := range lines[1:] {
+		parts := strings.Split(strings.TrimSpace(ll), ",")
+		if len(parts) != 2 || parts[1] == "." {
+			continue
+		}
+
+		dt, err := time.Parse("2006-01-02", parts[0])
+		if err != nil {
+			log.Warn().Str("Line", ll).Str("Ticker", seriesID).Err(err).Msg("could not parse observation date")
+			continue
+		}
+
+		val, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil {
+			log.Warn().Str("Line", ll).Str("Ticker", seriesID).Str("Val", parts[1]).Err(err).Msg("could not convert str to float")
+			continue
+		}
+
+		observations = append(observations, &Observation{Date: dt, Value: val})
+	}
+
+	return observations, nil
+}
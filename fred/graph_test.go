@@ -0,0 +1,115 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fred
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestGraphClientObservations(t *testing.T) {
+	body := "DATE,DGS10\n2024-01-02,3.95\n2024-01-03,.\n\nnot-a-date,1\n2024-01-04,abc\n2024-01-05,4.05\r\n"
+
+	tests := []struct {
+		name   string
+		ticker string
+		freq   Frequency
+		params url.Values
+		absent []string
+	}{
+		{
+			name:   "native levels",
+			ticker: "DGS10",
+			freq:   NativeFrequency,
+			params: url.Values{"id": {"DGS10"}, "cosd": {"2024-01-01"}, "coed": {"2024-01-31"}},
+			absent: []string{"fq", "fam", "transformation"},
+		},
+		{
+			name:   "aggregated transformation",
+			ticker: "DGS10:chg",
+			freq:   Frequency{Period: FrequencyWeekly, Aggregation: AggregationAverage},
+			params: url.Values{"id": {"DGS10"}, "fq": {"Weekly, Ending Friday"}, "fam": {"avg"}, "transformation": {"chg"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var query url.Values
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				query = r.URL.Query()
+				_, _ = w.Write([]byte(body))
+			}))
+			defer srv.Close()
+
+			client := NewGraphClient()
+			client.BaseURL = srv.URL
+
+			start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+			observations, err := client.Observations(context.Background(), tt.ticker, start, start.AddDate(0, 0, 30), tt.freq)
+			if err != nil {
+				t.Fatalf("Observations() error = %v", err)
+			}
+
+			for key, want := range tt.params {
+				if got := query.Get(key); got != want[0] {
+					t.Errorf("%s = %q, want %q", key, got, want[0])
+				}
+			}
+			for _, key := range tt.absent {
+				if query.Has(key) {
+					t.Errorf("unexpected parameter %s=%q", key, query.Get(key))
+				}
+			}
+
+			if len(observations) != 2 {
+				t.Fatalf("got %d observations, want 2", len(observations))
+			}
+			if observations[0].Date.Format("2006-01-02") != "2024-01-02" || observations[0].Value != 3.95 {
+				t.Errorf("first observation = %v %v", observations[0].Date, observations[0].Value)
+			}
+			if observations[1].Date.Format("2006-01-02") != "2024-01-05" || observations[1].Value != 4.05 {
+				t.Errorf("second observation = %v %v", observations[1].Date, observations[1].Value)
+			}
+		})
+	}
+}
+
+func TestGraphClientObservationsError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "5")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("unavailable"))
+	}))
+	defer srv.Close()
+
+	client := NewGraphClient()
+	client.BaseURL = srv.URL
+
+	_, err := client.Observations(context.Background(), "DGS10", time.Now(), time.Now(), NativeFrequency)
+
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("Observations() error = %v, want *APIError", err)
+	}
+	if apiErr.StatusCode != http.StatusServiceUnavailable || apiErr.Message != "unavailable" || apiErr.RetryAfter != 5*time.Second {
+		t.Errorf("APIError = %+v", apiErr)
+	}
+}
@@ -0,0 +1,206 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fred
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+	"go.uber.org/ratelimit"
+)
+
+const seriesMetadataTable = `CREATE TABLE IF NOT EXISTS series_metadata (
+	composite_figi TEXT PRIMARY KEY,
+	ticker TEXT NOT NULL,
+	source TEXT NOT NULL,
+	title TEXT,
+	units TEXT,
+	units_short TEXT,
+	frequency TEXT,
+	frequency_short TEXT,
+	seasonal_adjustment TEXT,
+	seasonal_adjustment_short TEXT,
+	observation_start DATE,
+	observation_end DATE,
+	last_updated TIMESTAMPTZ,
+	popularity INTEGER,
+	notes TEXT,
+	transformation TEXT,
+	refreshed_at TIMESTAMPTZ NOT NULL DEFAULT now()
+)`
+
+// seriesMetadataTransformation adds the transformation column to tables
+// created before derived series were supported
+const seriesMetadataTransformation = `ALTER TABLE series_metadata ADD COLUMN IF NOT EXISTS transformation TEXT`
+
+// RefreshMetadata retrieves the series description of each asset from its
+// source, stores it on the asset and saves it to the series_metadata
+// table. Rows are only rewritten when the source reports a different
+// last_updated time than the one stored.
+func RefreshMetadata(ctx context.Context, sources Sources, assets []*Asset) error {
+	conn, err := pgx.Connect(ctx, viper.GetString("database.url"))
+	if err != nil {
+		log.Error().Err(err).Msg("Could not connect to database")
+		return err
+	}
+	defer conn.Close(ctx)
+
+	stored, err := loadLastUpdated(ctx, conn)
+	if err != nil {
+		log.Error().Err(err).Msg("could not load stored series metadata")
+		return err
+	}
+
+	limit := ratelimit.New(viper.GetInt("fred_rate_limit"))
+	numUpdated := 0
+	unsupported := make(map[string]bool)
+	for _, asset := range assets {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		subLog := log.With().Str("Ticker", asset.Ticker).Logger()
+		src, err := sources.For(asset)
+		if err != nil {
+			subLog.Error().Err(err).Msg("cannot describe asset")
+			continue
+		}
+
+		if unsupported[src.Name()] {
+			continue
+		}
+
+		var series *Series
+		_, err = withRetry(ctx, asset.Ticker, func() (err error) {
+			limit.Take()
+			series, err = src.DescribeSeries(ctx, asset.Ticker)
+			return
+		})
+		if errors.Is(err, ErrMissingAPIKey) || errors.Is(err, ErrNotSupported) {
+			log.Warn().Err(err).Str("Source", src.Name()).Msg("source does not provide series metadata")
+			unsupported[src.Name()] = true
+			continue
+		}
+		if err != nil {
+			subLog.Error().Err(err).Msg("could not retrieve series metadata")
+			continue
+		}
+
+		asset.Series = series
+
+		if lastUpdated, ok := stored[asset.CompositeFigi]; ok && lastUpdated.Equal(series.LastUpdated) {
+			continue
+		}
+
+		if err = saveMetadata(ctx, conn, src, asset, series); err != nil {
+			subLog.Error().Err(err).Msg("could not save series metadata")
+			continue
+		}
+
+		subLog.Info().Time("LastUpdated", series.LastUpdated).Msg("series metadata updated")
+		numUpdated++
+	}
+
+	log.Info().Int("NumUpdated", numUpdated).Msg("series metadata refreshed")
+	return nil
+}
+
+// loadLastUpdated returns the stored last_updated time keyed by composite figi
+func loadLastUpdated(ctx context.Context, conn *pgx.Conn) (map[string]time.Time, error) {
+	rows, err := conn.Query(ctx, `SELECT composite_figi, last_updated FROM series_metadata WHERE last_updated IS NOT NULL`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stored := make(map[string]time.Time)
+	for rows.Next() {
+		var figi string
+		var lastUpdated time.Time
+		if err = rows.Scan(&figi, &lastUpdated); err != nil {
+			return nil, err
+		}
+		stored[figi] = lastUpdated
+	}
+
+	return stored, rows.Err()
+}
+
+func saveMetadata(ctx context.Context, conn *pgx.Conn, src Source, asset *Asset, series *Series) error {
+	_, err := conn.Exec(ctx, `INSERT INTO series_metadata (
+		composite_figi,
+		ticker,
+		source,
+		title,
+		units,
+		units_short,
+		frequency,
+		frequency_short,
+		seasonal_adjustment,
+		seasonal_adjustment_short,
+		observation_start,
+		observation_end,
+		last_updated,
+		popularity,
+		notes,
+		transformation,
+		refreshed_at
+	) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, now())
+	ON CONFLICT (composite_figi) DO UPDATE SET
+		ticker = EXCLUDED.ticker,
+		source = EXCLUDED.source,
+		title = EXCLUDED.title,
+		units = EXCLUDED.units,
+		units_short = EXCLUDED.units_short,
+		frequency = EXCLUDED.frequency,
+		frequency_short = EXCLUDED.frequency_short,
+		seasonal_adjustment = EXCLUDED.seasonal_adjustment,
+		seasonal_adjustment_short = EXCLUDED.seasonal_adjustment_short,
+		observation_start = EXCLUDED.observation_start,
+		observation_end = EXCLUDED.observation_end,
+		last_updated = EXCLUDED.last_updated,
+		popularity = EXCLUDED.popularity,
+		notes = EXCLUDED.notes,
+		transformation = EXCLUDED.transformation,
+		refreshed_at = EXCLUDED.refreshed_at`,
+		asset.CompositeFigi, asset.Ticker, src.Label(),
+		series.Title, series.Units, series.UnitsShort,
+		series.Frequency, series.FrequencyShort,
+		series.SeasonalAdjustment, series.SeasonalAdjustmentShort,
+		nullTime(series.ObservationStart), nullTime(series.ObservationEnd), nullTime(series.LastUpdated),
+		series.Popularity, series.Notes, nullString(series.Transformation))
+	return err
+}
+
+// nullString maps the empty string to NULL
+func nullString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// nullTime maps the zero time to NULL
+func nullTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
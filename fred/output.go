@@ -0,0 +1,395 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fred
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/apache/arrow/go/arrow/ipc"
+	"github.com/apache/arrow/go/arrow/memory"
+	"github.com/rs/zerolog/log"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/source"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// Output formats
+const (
+	FormatParquet = "parquet"
+	FormatCSV     = "csv"
+	FormatNDJSON  = "ndjson"
+	FormatArrow   = "arrow"
+)
+
+var ErrUnknownFormat = errors.New("unknown output format")
+
+// formatExtensions maps file extensions to the output format they imply
+var formatExtensions = map[string]string{
+	".parquet": FormatParquet,
+	".csv":     FormatCSV,
+	".ndjson":  FormatNDJSON,
+	".jsonl":   FormatNDJSON,
+	".arrow":   FormatArrow,
+	".feather": FormatArrow,
+	".ipc":     FormatArrow,
+}
+
+// formatContentTypes are the media types of files written in each format
+var formatContentTypes = map[string]string{
+	FormatParquet: "application/vnd.apache.parquet",
+	FormatCSV:     "text/csv",
+	FormatNDJSON:  "application/x-ndjson",
+	FormatArrow:   "application/vnd.apache.arrow.file",
+}
+
+// FormatExtension returns the file extension of files written in format
+func FormatExtension(format string) string {
+	return "." + format
+}
+
+// OutputFormat returns format if it is set and otherwise the format implied
+// by the extension of fn. Files without a known extension are written as
+// parquet.
+func OutputFormat(format, fn string) (string, error) {
+	if format != "" {
+		format = strings.ToLower(format)
+		switch format {
+		case FormatParquet, FormatCSV, FormatNDJSON, FormatArrow:
+			return format, nil
+		}
+		return "", fmt.Errorf("%w: %s", ErrUnknownFormat, format)
+	}
+
+	if format, ok := formatExtensions[strings.ToLower(filepath.Ext(fn))]; ok {
+		return format, nil
+	}
+	return FormatParquet, nil
+}
+
+// recordEncoder encodes Eod records in one output format. Every format
+// except parquet names its columns after the json tags of Eod.
+type recordEncoder interface {
+	encode(quote *Eod) error
+
+	// finish flushes buffered records and writes any trailer; it does not
+	// close the underlying file
+	finish() error
+}
+
+// outputFile is a file of Eod records that is being written
+type outputFile struct {
+	fn         string
+	fh         source.ParquetFile
+	enc        recordEncoder
+	numRecords int
+
+	// minDate and maxDate bound the event dates written to the file
+	minDate string
+	maxDate string
+}
+
+// createOutputFile creates the file fn and writes records to it in format.
+// fn is either a local path or an s3://bucket/key url.
+func createOutputFile(ctx context.Context, fn, format string) (*outputFile, error) {
+	var fh source.ParquetFile
+	var err error
+	if IsS3URL(fn) {
+		fh, err = newS3FileWriter(ctx, fn, format)
+	} else {
+		fh, err = local.NewLocalFileWriter(fn)
+	}
+	if err != nil {
+		log.Error().Err(err).Str("FileName", fn).Msg("cannot create file")
+		return nil, err
+	}
+
+	var enc recordEncoder
+	switch format {
+	case FormatParquet:
+		enc, err = newParquetEncoder(fh)
+	case FormatCSV:
+		enc, err = newCSVEncoder(fh)
+	case FormatNDJSON:
+		enc = newNDJSONEncoder(fh)
+	case FormatArrow:
+		enc, err = newArrowEncoder(fh)
+	default:
+		err = fmt.Errorf("%w: %s", ErrUnknownFormat, format)
+	}
+	if err != nil {
+		log.Error().Err(err).Str("FileName", fn).Str("Format", format).Msg("could not start output file")
+		abortFile(fh, err)
+		return nil, err
+	}
+
+	return &outputFile{fn: fn, fh: fh, enc: enc}, nil
+}
+
+// write appends quotes to the file. It stops at the first record that
+// cannot be encoded and returns the error; only encoded records are counted.
+func (f *outputFile) write(quotes []*Eod) error {
+	for _, r := range quotes {
+		if err := f.enc.encode(r); err != nil {
+			log.Error().
+				Str("OriginalError", err.Error()).
+				Str("EventDate", r.Date).Str("Ticker", r.Ticker).
+				Str("CompositeFigi", r.CompositeFigi).
+				Msg("write failed for record")
+			return err
+		}
+
+		f.numRecords++
+		if f.minDate == "" || r.Date < f.minDate {
+			f.minDate = r.Date
+		}
+		if r.Date > f.maxDate {
+			f.maxDate = r.Date
+		}
+	}
+	return nil
+}
+
+// close finishes the file and closes it
+func (f *outputFile) close() error {
+	if err := f.enc.finish(); err != nil {
+		log.Error().Err(err).Str("FileName", f.fn).Msg("write failed")
+		abortFile(f.fh, err)
+		return err
+	}
+
+	if err := f.fh.Close(); err != nil {
+		log.Error().Err(err).Str("FileName", f.fn).Msg("could not close output file")
+		return err
+	}
+	return nil
+}
+
+// abortFile closes a file that could not be written completely. Uploads
+// are canceled so that the incomplete file is never published.
+func abortFile(fh source.ParquetFile, cause error) {
+	if upload, ok := fh.(*s3File); ok {
+		upload.Abort(cause)
+		return
+	}
+	fh.Close()
+}
+
+// parquetEncoder writes records with the parquet schema of Eod
+type parquetEncoder struct {
+	pw *writer.ParquetWriter
+}
+
+func newParquetEncoder(fh source.ParquetFile) (*parquetEncoder, error) {
+	pw, err := writer.NewParquetWriter(fh, new(Eod), 4)
+	if err != nil {
+		return nil, err
+	}
+
+	pw.RowGroupSize = 128 * 1024 * 1024 // 128M
+	pw.PageSize = 8 * 1024              // 8k
+	pw.CompressionType = parquet.CompressionCodec_GZIP
+
+	schemaVersion := strconv.Itoa(EodSchemaVersion)
+	pw.Footer.KeyValueMetadata = append(pw.Footer.KeyValueMetadata, &parquet.KeyValue{
+		Key:   "schema_version",
+		Value: &schemaVersion,
+	})
+
+	return &parquetEncoder{pw: pw}, nil
+}
+
+func (e *parquetEncoder) encode(quote *Eod) error {
+	return e.pw.Write(quote)
+}
+
+func (e *parquetEncoder) finish() error {
+	return e.pw.WriteStop()
+}
+
+// eodFieldNames are the column names of the csv and arrow formats
+var eodFieldNames = []string{
+	"date", "ticker", "exchange", "assetType", "compositeFigi", "open", "high",
+	"low", "close", "volume", "divCash", "splitFactor", "frequency",
+}
+
+// csvEncoder writes a header row followed by one row per record
+type csvEncoder struct {
+	w   *csv.Writer
+	row []string
+}
+
+func newCSVEncoder(w io.Writer) (*csvEncoder, error) {
+	enc := &csvEncoder{w: csv.NewWriter(w), row: make([]string, len(eodFieldNames))}
+	if err := enc.w.Write(eodFieldNames); err != nil {
+		return nil, err
+	}
+	return enc, nil
+}
+
+func (e *csvEncoder) encode(quote *Eod) error {
+	e.row[0] = quote.Date
+	e.row[1] = quote.Ticker
+	e.row[2] = quote.Exchange
+	e.row[3] = quote.AssetType
+	e.row[4] = quote.CompositeFigi
+	e.row[5] = formatFloat(quote.Open)
+	e.row[6] = formatFloat(quote.High)
+	e.row[7] = formatFloat(quote.Low)
+	e.row[8] = formatFloat(quote.Close)
+	e.row[9] = strconv.FormatInt(quote.Volume, 10)
+	e.row[10] = formatFloat(quote.Dividend)
+	e.row[11] = formatFloat(quote.Split)
+	e.row[12] = quote.Frequency
+	return e.w.Write(e.row)
+}
+
+func (e *csvEncoder) finish() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// formatFloat formats v with the fewest digits that represent it exactly
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// ndjsonEncoder writes each record as a json object on its own line
+type ndjsonEncoder struct {
+	buf *bufio.Writer
+	enc *json.Encoder
+}
+
+func newNDJSONEncoder(w io.Writer) *ndjsonEncoder {
+	buf := bufio.NewWriter(w)
+	return &ndjsonEncoder{buf: buf, enc: json.NewEncoder(buf)}
+}
+
+func (e *ndjsonEncoder) encode(quote *Eod) error {
+	return e.enc.Encode(quote)
+}
+
+func (e *ndjsonEncoder) finish() error {
+	return e.buf.Flush()
+}
+
+// arrowBatchSize is the number of rows in each arrow record batch
+const arrowBatchSize = 64 * 1024
+
+// arrowEncoder writes records to an Arrow IPC file (Feather v2) in batches
+// of arrowBatchSize rows
+type arrowEncoder struct {
+	fw      *ipc.FileWriter
+	builder *array.RecordBuilder
+	rows    int
+}
+
+func newArrowEncoder(w io.Writer) (*arrowEncoder, error) {
+	types := []arrow.DataType{
+		arrow.BinaryTypes.String, arrow.BinaryTypes.String, arrow.BinaryTypes.String,
+		arrow.BinaryTypes.String, arrow.BinaryTypes.String, arrow.PrimitiveTypes.Float64,
+		arrow.PrimitiveTypes.Float64, arrow.PrimitiveTypes.Float64, arrow.PrimitiveTypes.Float64,
+		arrow.PrimitiveTypes.Int64, arrow.PrimitiveTypes.Float64, arrow.PrimitiveTypes.Float64,
+		arrow.BinaryTypes.String,
+	}
+	fields := make([]arrow.Field, len(eodFieldNames))
+	for idx, name := range eodFieldNames {
+		fields[idx] = arrow.Field{Name: name, Type: types[idx]}
+	}
+
+	metadata := arrow.NewMetadata([]string{"schema_version"}, []string{strconv.Itoa(EodSchemaVersion)})
+	schema := arrow.NewSchema(fields, &metadata)
+
+	fw, err := ipc.NewFileWriter(&offsetWriter{w: w}, ipc.WithSchema(schema))
+	if err != nil {
+		return nil, err
+	}
+
+	return &arrowEncoder{
+		fw:      fw,
+		builder: array.NewRecordBuilder(memory.NewGoAllocator(), schema),
+	}, nil
+}
+
+func (e *arrowEncoder) encode(quote *Eod) error {
+	for idx, val := range []string{quote.Date, quote.Ticker, quote.Exchange, quote.AssetType, quote.CompositeFigi} {
+		e.builder.Field(idx).(*array.StringBuilder).Append(val)
+	}
+	for idx, val := range []float64{quote.Open, quote.High, quote.Low, quote.Close} {
+		e.builder.Field(5 + idx).(*array.Float64Builder).Append(val)
+	}
+	e.builder.Field(9).(*array.Int64Builder).Append(quote.Volume)
+	e.builder.Field(10).(*array.Float64Builder).Append(quote.Dividend)
+	e.builder.Field(11).(*array.Float64Builder).Append(quote.Split)
+	e.builder.Field(12).(*array.StringBuilder).Append(quote.Frequency)
+
+	e.rows++
+	if e.rows >= arrowBatchSize {
+		return e.flush()
+	}
+	return nil
+}
+
+// flush writes the buffered rows as a record batch
+func (e *arrowEncoder) flush() error {
+	rec := e.builder.NewRecord()
+	defer rec.Release()
+	e.rows = 0
+	return e.fw.Write(rec)
+}
+
+func (e *arrowEncoder) finish() error {
+	defer e.builder.Release()
+
+	if e.rows > 0 {
+		if err := e.flush(); err != nil {
+			return err
+		}
+	}
+	return e.fw.Close()
+}
+
+// offsetWriter tracks the number of bytes written so that the arrow file
+// writer, which only queries its current position, can write to files that
+// do not support seeking (e.g. s3 uploads)
+type offsetWriter struct {
+	w      io.Writer
+	offset int64
+}
+
+func (o *offsetWriter) Write(p []byte) (int, error) {
+	n, err := o.w.Write(p)
+	o.offset += int64(n)
+	return n, err
+}
+
+func (o *offsetWriter) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != io.SeekCurrent {
+		return 0, errors.New("offsetWriter only reports its current position")
+	}
+	return o.offset, nil
+}
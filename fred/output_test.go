@@ -0,0 +1,331 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fred
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/apache/arrow/go/arrow/ipc"
+)
+
+var errEncode = errors.New("encode failed")
+
+// failingEncoder fails to encode the quote dated failDate
+type failingEncoder struct {
+	failDate string
+	encoded  []string
+}
+
+func (e *failingEncoder) encode(quote *Eod) error {
+	if quote.Date == e.failDate {
+		return errEncode
+	}
+	e.encoded = append(e.encoded, quote.Date)
+	return nil
+}
+
+func (e *failingEncoder) finish() error {
+	return nil
+}
+
+func quotesOn(dates ...string) []*Eod {
+	quotes := make([]*Eod, len(dates))
+	for idx, date := range dates {
+		quotes[idx] = &Eod{Date: date, Ticker: "DGS10"}
+	}
+	return quotes
+}
+
+func TestOutputFileWrite(t *testing.T) {
+	tests := []struct {
+		name       string
+		quotes     []*Eod
+		failDate   string
+		err        error
+		numRecords int
+		minDate    string
+		maxDate    string
+	}{
+		{
+			name:       "all encoded",
+			quotes:     quotesOn("2022-01-04", "2022-01-03", "2022-01-05"),
+			numRecords: 3,
+			minDate:    "2022-01-03",
+			maxDate:    "2022-01-05",
+		},
+		{
+			name:     "first record fails",
+			quotes:   quotesOn("2022-01-03", "2022-01-04"),
+			failDate: "2022-01-03",
+			err:      errEncode,
+		},
+		{
+			name:       "failed record is not counted",
+			quotes:     quotesOn("2022-01-04", "2022-01-05", "2022-01-03"),
+			failDate:   "2022-01-03",
+			err:        errEncode,
+			numRecords: 2,
+			minDate:    "2022-01-04",
+			maxDate:    "2022-01-05",
+		},
+		{
+			name:       "stops at the failed record",
+			quotes:     quotesOn("2022-01-03", "2022-01-04", "2022-01-05"),
+			failDate:   "2022-01-04",
+			err:        errEncode,
+			numRecords: 1,
+			minDate:    "2022-01-03",
+			maxDate:    "2022-01-03",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &outputFile{fn: "test", enc: &failingEncoder{failDate: tt.failDate}}
+
+			if err := f.write(tt.quotes); !errors.Is(err, tt.err) {
+				t.Fatalf("write() error = %v, want %v", err, tt.err)
+			}
+			if f.numRecords != tt.numRecords {
+				t.Errorf("numRecords = %d, want %d", f.numRecords, tt.numRecords)
+			}
+			if f.minDate != tt.minDate || f.maxDate != tt.maxDate {
+				t.Errorf("dates = [%q, %q], want [%q, %q]", f.minDate, f.maxDate, tt.minDate, tt.maxDate)
+			}
+		})
+	}
+}
+
+func TestStreamMarksEncodeFailures(t *testing.T) {
+	enc := &failingEncoder{failDate: "2022-01-04"}
+	sink := &FileSink{file: &outputFile{fn: "test", enc: enc}}
+
+	ok := &AssetResult{Asset: &Asset{Ticker: "DGS10"}, Quotes: quotesOn("2022-01-03")}
+	failed := &AssetResult{Asset: &Asset{Ticker: "DGS3MO"}, Quotes: quotesOn("2022-01-04")}
+
+	emit, wait := stream(context.Background(), sink)
+	emit(0, ok)
+	emit(1, failed)
+	wait()
+
+	if ok.Failed() {
+		t.Errorf("asset DGS10 failed: %v", ok.Err)
+	}
+	if !errors.Is(failed.Err, errEncode) {
+		t.Errorf("asset DGS3MO error = %v, want %v", failed.Err, errEncode)
+	}
+	if sink.file.numRecords != 1 {
+		t.Errorf("numRecords = %d, want 1", sink.file.numRecords)
+	}
+}
+
+// encoderQuotes covers fractional, large, tiny and negative values
+var encoderQuotes = []*Eod{
+	{Date: "2022-01-03", Ticker: "DGS10", Exchange: ExchangeFRED, AssetType: AssetTypeFRED, CompositeFigi: "FRED000DGS10",
+		Open: 1.63, High: 1.63, Low: 1.63, Close: 1.63, Split: 1, Frequency: "native", Source: LabelFRED},
+	{Date: "2022-01-04", Ticker: "GDP", Exchange: ExchangeFRED, AssetType: AssetTypeFRED, CompositeFigi: "FRED00000GDP",
+		Open: 24002815.5, High: 1e21, Low: 0.0000001, Close: -0.1, Volume: 1234567890123, Dividend: 0.25, Split: 1, Frequency: "quarterly:avg"},
+}
+
+// eodJSONNames returns the json field names of Eod in declaration order
+func eodJSONNames() []string {
+	typ := reflect.TypeOf(Eod{})
+	names := make([]string, 0, typ.NumField())
+	for idx := 0; idx < typ.NumField(); idx++ {
+		name, _, _ := strings.Cut(typ.Field(idx).Tag.Get("json"), ",")
+		if name != "-" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func TestEodFieldNamesMatchJSON(t *testing.T) {
+	if names := eodJSONNames(); !reflect.DeepEqual(eodFieldNames, names) {
+		t.Errorf("eodFieldNames = %v, want the json names of Eod %v", eodFieldNames, names)
+	}
+}
+
+func TestCSVEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	enc, err := newCSVEncoder(&buf)
+	if err != nil {
+		t.Fatalf("newCSVEncoder() error = %v", err)
+	}
+	for _, quote := range encoderQuotes {
+		if err = enc.encode(quote); err != nil {
+			t.Fatalf("encode() error = %v", err)
+		}
+	}
+	if err = enc.finish(); err != nil {
+		t.Fatalf("finish() error = %v", err)
+	}
+
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("output is not csv: %v", err)
+	}
+
+	want := [][]string{
+		eodJSONNames(),
+		{"2022-01-03", "DGS10", ExchangeFRED, AssetTypeFRED, "FRED000DGS10", "1.63", "1.63", "1.63", "1.63", "0", "0", "1", "native"},
+		{"2022-01-04", "GDP", ExchangeFRED, AssetTypeFRED, "FRED00000GDP", "24002815.5", "1000000000000000000000", "0.0000001", "-0.1", "1234567890123", "0.25", "1", "quarterly:avg"},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("csv rows = %q, want %q", rows, want)
+	}
+
+	// values are written without loss of precision
+	for idx, quote := range encoderQuotes {
+		got, err := strconv.ParseFloat(rows[idx+1][8], 64)
+		if err != nil || got != quote.Close {
+			t.Errorf("row %d close = %q, want %v", idx+1, rows[idx+1][8], quote.Close)
+		}
+	}
+}
+
+func TestNDJSONEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	enc := newNDJSONEncoder(&buf)
+	for _, quote := range encoderQuotes {
+		if err := enc.encode(quote); err != nil {
+			t.Fatalf("encode() error = %v", err)
+		}
+	}
+	if err := enc.finish(); err != nil {
+		t.Fatalf("finish() error = %v", err)
+	}
+
+	names := eodJSONNames()
+	scanner := bufio.NewScanner(&buf)
+	line := 0
+	for ; scanner.Scan(); line++ {
+		if line >= len(encoderQuotes) {
+			t.Fatalf("more lines than quotes: %s", scanner.Text())
+		}
+
+		var fields map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &fields); err != nil {
+			t.Fatalf("line %d is not a json object: %v", line, err)
+		}
+		if len(fields) != len(names) {
+			t.Errorf("line %d has %d fields, want %d", line, len(fields), len(names))
+		}
+		for _, name := range names {
+			if _, ok := fields[name]; !ok {
+				t.Errorf("line %d is missing field %q", line, name)
+			}
+		}
+		if _, ok := fields["Source"]; ok {
+			t.Errorf("line %d exports the source label", line)
+		}
+
+		var quote Eod
+		if err := json.Unmarshal(scanner.Bytes(), &quote); err != nil {
+			t.Fatalf("line %d does not decode into Eod: %v", line, err)
+		}
+		want := *encoderQuotes[line]
+		want.Source = ""
+		if quote != want {
+			t.Errorf("line %d = %+v, want %+v", line, quote, want)
+		}
+	}
+	if line != len(encoderQuotes) {
+		t.Errorf("read %d lines, want %d", line, len(encoderQuotes))
+	}
+}
+
+func TestArrowEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	enc, err := newArrowEncoder(&buf)
+	if err != nil {
+		t.Fatalf("newArrowEncoder() error = %v", err)
+	}
+
+	// one full batch and one row in a second batch
+	numRows := arrowBatchSize + 1
+	for idx := 0; idx < numRows; idx++ {
+		quote := *encoderQuotes[idx%len(encoderQuotes)]
+		quote.Volume = int64(idx)
+		if err = enc.encode(&quote); err != nil {
+			t.Fatalf("encode() error = %v", err)
+		}
+	}
+	if err = enc.finish(); err != nil {
+		t.Fatalf("finish() error = %v", err)
+	}
+
+	fr, err := ipc.NewFileReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("ipc.NewFileReader() error = %v", err)
+	}
+	defer fr.Close()
+
+	schema := fr.Schema()
+	names := make([]string, 0, len(schema.Fields()))
+	for _, field := range schema.Fields() {
+		names = append(names, field.Name)
+	}
+	if !reflect.DeepEqual(names, eodJSONNames()) {
+		t.Errorf("arrow columns = %v, want %v", names, eodJSONNames())
+	}
+
+	md := schema.Metadata()
+	if idx := md.FindKey("schema_version"); idx < 0 || md.Values()[idx] != strconv.Itoa(EodSchemaVersion) {
+		t.Errorf("schema metadata = %v, want schema_version %d", md, EodSchemaVersion)
+	}
+
+	if fr.NumRecords() != 2 {
+		t.Fatalf("arrow file has %d record batches, want 2", fr.NumRecords())
+	}
+
+	wantRows := []int64{arrowBatchSize, 1}
+	offset := 0
+	for batch := 0; batch < fr.NumRecords(); batch++ {
+		rec, err := fr.Record(batch)
+		if err != nil {
+			t.Fatalf("Record(%d) error = %v", batch, err)
+		}
+		if rec.NumRows() != wantRows[batch] {
+			t.Errorf("batch %d has %d rows, want %d", batch, rec.NumRows(), wantRows[batch])
+		}
+
+		dates := rec.Column(0).(*array.String)
+		closes := rec.Column(8).(*array.Float64)
+		volumes := rec.Column(9).(*array.Int64)
+		frequencies := rec.Column(12).(*array.String)
+		for _, row := range []int{0, int(rec.NumRows()) - 1} {
+			idx := offset + row
+			want := encoderQuotes[idx%len(encoderQuotes)]
+			if dates.Value(row) != want.Date || closes.Value(row) != want.Close || volumes.Value(row) != int64(idx) || frequencies.Value(row) != want.Frequency {
+				t.Errorf("row %d = {%s %v %d %s}, want {%s %v %d %s}", idx,
+					dates.Value(row), closes.Value(row), volumes.Value(row), frequencies.Value(row),
+					want.Date, want.Close, idx, want.Frequency)
+			}
+		}
+		offset += int(rec.NumRows())
+	}
+}
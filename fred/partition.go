@@ -0,0 +1,349 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fred
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var ErrUnknownPartitionKey = errors.New("unknown partition key")
+
+// partitionKeys maps each supported partition key to the value of a quote
+var partitionKeys = map[string]func(*Eod) string{
+	"ticker":         func(q *Eod) string { return q.Ticker },
+	"composite_figi": func(q *Eod) string { return q.CompositeFigi },
+	"asset_type":     func(q *Eod) string { return q.AssetType },
+	"exchange":       func(q *Eod) string { return q.Exchange },
+	"frequency":      func(q *Eod) string { return q.Frequency },
+	"year":           func(q *Eod) string { return q.Date[:4] },
+	"month":          func(q *Eod) string { return q.Date[5:7] },
+}
+
+// DefaultPartitionBy is the partition layout used when none is configured
+var DefaultPartitionBy = []string{"ticker", "year"}
+
+// maxOpenPartitions bounds the number of files a PartitionedSink keeps
+// open. Layouts without a ticker or composite_figi key keep their files
+// open across assets; when the limit is reached the least recently written
+// file is closed and a later quote for its partition starts a new part.
+const maxOpenPartitions = 64
+
+// ManifestFile describes a file written during a run
+type ManifestFile struct {
+	// Path is relative to the output directory and uses forward slashes
+	Path      string            `json:"path"`
+	Partition map[string]string `json:"partition"`
+	Rows      int               `json:"rows"`
+	MinDate   string            `json:"minDate"`
+	MaxDate   string            `json:"maxDate"`
+	Bytes     int64             `json:"bytes"`
+	SHA256    string            `json:"sha256"`
+}
+
+// Manifest lists the files written by a run
+type Manifest struct {
+	RunID         string          `json:"runId"`
+	SchemaVersion int             `json:"schemaVersion"`
+	Format        string          `json:"format"`
+	CreatedAt     time.Time       `json:"createdAt"`
+	PartitionBy   []string        `json:"partitionBy"`
+	Files         []*ManifestFile `json:"files"`
+}
+
+// PartitionedSink writes quotes into a Hive-style directory layout, e.g.
+// ticker=DGS10/year=2024/part-<run id>-00000.parquet, and records
+// every file in a manifest written when the sink is closed. File names
+// include the run id so that successive runs add files rather than
+// replacing them.
+type PartitionedSink struct {
+	dir         string
+	format      string
+	partitionBy []string
+	manifestFn  string
+	manifest    *Manifest
+
+	// open holds the file being written for each partition path; lastUsed
+	// orders them by their most recent write
+	open       map[string]*outputFile
+	partitions map[string]map[string]string
+	lastUsed   map[string]int
+	writes     int
+	maxOpen    int
+	seq        int
+
+	// closePerAsset is set when each asset maps to its own partitions so
+	// that files can be closed as soon as the asset has been written
+	closePerAsset bool
+}
+
+// NewPartitionedSink creates a partitioned writer below dir that writes
+// files in format (parquet when empty). The manifest is written to
+// manifestFn or, when it is empty, to dir/manifest-<run id>.json.
+func NewPartitionedSink(ctx context.Context, dir, format string, partitionBy []string, manifestFn string) (*PartitionedSink, error) {
+	format, err := OutputFormat(format, "")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(partitionBy) == 0 {
+		partitionBy = DefaultPartitionBy
+	}
+
+	closePerAsset := false
+	for _, key := range partitionBy {
+		if _, ok := partitionKeys[key]; !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownPartitionKey, key)
+		}
+		if key == "ticker" || key == "composite_figi" {
+			closePerAsset = true
+		}
+	}
+
+	if IsS3URL(dir) {
+		return nil, fmt.Errorf("%w: partitioned output must be written to a local directory", ErrInvalidS3URL)
+	}
+
+	if err = os.MkdirAll(dir, 0o755); err != nil {
+		log.Error().Err(err).Str("Dir", dir).Msg("cannot create output directory")
+		return nil, err
+	}
+
+	runID := RunID(ctx)
+	if runID == "" {
+		runID = NewRunID()
+	}
+
+	if manifestFn == "" {
+		manifestFn = filepath.Join(dir, "manifest-"+runID+".json")
+	}
+
+	return &PartitionedSink{
+		dir:         dir,
+		format:      format,
+		partitionBy: partitionBy,
+		manifestFn:  manifestFn,
+		manifest: &Manifest{
+			RunID:         runID,
+			SchemaVersion: EodSchemaVersion,
+			Format:        format,
+			PartitionBy:   partitionBy,
+			Files:         make([]*ManifestFile, 0),
+		},
+		open:          make(map[string]*outputFile),
+		partitions:    make(map[string]map[string]string),
+		lastUsed:      make(map[string]int),
+		maxOpen:       maxOpenPartitions,
+		closePerAsset: closePerAsset,
+	}, nil
+}
+
+// escapePartitionValue escapes the characters Hive does not allow in
+// partition directory names
+func escapePartitionValue(value string) string {
+	if value == "" {
+		return "__HIVE_DEFAULT_PARTITION__"
+	}
+
+	var sb strings.Builder
+	for idx := 0; idx < len(value); idx++ {
+		ch := value[idx]
+		if ch < 0x20 || ch == 0x7f || strings.IndexByte(`"#%'*/:=?\{[]^`, ch) >= 0 {
+			fmt.Fprintf(&sb, "%%%02X", ch)
+			continue
+		}
+		sb.WriteByte(ch)
+	}
+	return sb.String()
+}
+
+func (s *PartitionedSink) Write(ctx context.Context, result *AssetResult) error {
+	if err := s.writeQuotes(ctx, result.Quotes); err != nil {
+		return err
+	}
+	if s.closePerAsset && !result.Partial {
+		return s.closeOpen()
+	}
+	return nil
+}
+
+// writeQuotes appends each quote to the file of its partition, creating
+// the file on first use. At most maxOpen files are kept open.
+func (s *PartitionedSink) writeQuotes(ctx context.Context, quotes []*Eod) error {
+	for _, quote := range quotes {
+		values := make(map[string]string, len(s.partitionBy))
+		parts := make([]string, 0, len(s.partitionBy))
+		for _, key := range s.partitionBy {
+			value := partitionKeys[key](quote)
+			values[key] = value
+			parts = append(parts, key+"="+escapePartitionValue(value))
+		}
+		partition := strings.Join(parts, "/")
+
+		file, ok := s.open[partition]
+		if !ok {
+			if len(s.open) >= s.maxOpen {
+				if err := s.closeLeastRecentlyUsed(); err != nil {
+					return err
+				}
+			}
+
+			partitionDir := filepath.Join(s.dir, filepath.FromSlash(partition))
+			if err := os.MkdirAll(partitionDir, 0o755); err != nil {
+				log.Error().Err(err).Str("Dir", partitionDir).Msg("cannot create partition directory")
+				return err
+			}
+
+			fn := filepath.Join(partitionDir, fmt.Sprintf("part-%s-%05d%s", s.manifest.RunID, s.seq, FormatExtension(s.format)))
+			s.seq++
+
+			var err error
+			if file, err = createOutputFile(ctx, fn, s.format); err != nil {
+				return err
+			}
+			s.open[partition] = file
+			s.partitions[partition] = values
+		}
+
+		s.writes++
+		s.lastUsed[partition] = s.writes
+		if err := file.write([]*Eod{quote}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// closeLeastRecentlyUsed closes the open file that was written to least
+// recently
+func (s *PartitionedSink) closeLeastRecentlyUsed() error {
+	oldest := ""
+	for partition := range s.open {
+		if oldest == "" || s.lastUsed[partition] < s.lastUsed[oldest] {
+			oldest = partition
+		}
+	}
+	return s.closePartition(oldest)
+}
+
+// closeOpen finishes every open file and adds it to the manifest
+func (s *PartitionedSink) closeOpen() error {
+	partitions := make([]string, 0, len(s.open))
+	for partition := range s.open {
+		partitions = append(partitions, partition)
+	}
+	sort.Strings(partitions)
+
+	var errs []error
+	for _, partition := range partitions {
+		if err := s.closePartition(partition); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// closePartition finishes the open file of partition and adds it to the
+// manifest
+func (s *PartitionedSink) closePartition(partition string) error {
+	file := s.open[partition]
+	values := s.partitions[partition]
+	delete(s.open, partition)
+	delete(s.partitions, partition)
+	delete(s.lastUsed, partition)
+
+	if err := file.close(); err != nil {
+		return err
+	}
+
+	checksum, size, err := sha256File(file.fn)
+	if err != nil {
+		log.Error().Err(err).Str("FileName", file.fn).Msg("could not compute checksum")
+		return err
+	}
+
+	rel, err := filepath.Rel(s.dir, file.fn)
+	if err != nil {
+		rel = file.fn
+	}
+
+	s.manifest.Files = append(s.manifest.Files, &ManifestFile{
+		Path:      filepath.ToSlash(rel),
+		Partition: values,
+		Rows:      file.numRecords,
+		MinDate:   file.minDate,
+		MaxDate:   file.maxDate,
+		Bytes:     size,
+		SHA256:    checksum,
+	})
+	return nil
+}
+
+// Close finishes the open files and writes the manifest
+func (s *PartitionedSink) Close(ctx context.Context) error {
+	err := s.closeOpen()
+
+	sort.Slice(s.manifest.Files, func(i, j int) bool {
+		return s.manifest.Files[i].Path < s.manifest.Files[j].Path
+	})
+	s.manifest.CreatedAt = time.Now().UTC()
+
+	data, jsonErr := json.MarshalIndent(s.manifest, "", "  ")
+	if jsonErr != nil {
+		return errors.Join(err, jsonErr)
+	}
+	if writeErr := os.WriteFile(s.manifestFn, data, 0o644); writeErr != nil {
+		log.Error().Err(writeErr).Str("FileName", s.manifestFn).Msg("could not write manifest")
+		return errors.Join(err, writeErr)
+	}
+
+	rows := 0
+	for _, file := range s.manifest.Files {
+		rows += file.Rows
+	}
+	log.Info().Int("NumFiles", len(s.manifest.Files)).Int("NumRecords", rows).Str("Manifest", s.manifestFn).Msg("partitioned write finished")
+	return err
+}
+
+// sha256File returns the hex encoded SHA-256 checksum and size of a file
+func sha256File(fn string) (string, int64, error) {
+	fh, err := os.Open(fn)
+	if err != nil {
+		return "", 0, err
+	}
+	defer fh.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, fh)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
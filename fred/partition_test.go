@@ -0,0 +1,187 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fred
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestEscapePartitionValue(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"", "__HIVE_DEFAULT_PARTITION__"},
+		{"DGS10", "DGS10"},
+		{"2022", "2022"},
+		{"a/b", "a%2Fb"},
+		{"k=v", "k%3Dv"},
+		{"100%", "100%25"},
+		{"CPIAUCSL:pc1", "CPIAUCSL%3Apc1"},
+		{"tab\there", "tab%09here"},
+		{"ok-_.~ ", "ok-_.~ "},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			if got := escapePartitionValue(tt.value); got != tt.want {
+				t.Errorf("escapePartitionValue(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+// partitionQuote returns a quote of ticker on date
+func partitionQuote(ticker, date string) *Eod {
+	return &Eod{Ticker: ticker, Date: date, Close: 1, Split: 1, Frequency: "d"}
+}
+
+// readManifest reads the manifest written by sink
+func readManifest(t *testing.T, fn string) *Manifest {
+	t.Helper()
+
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatalf("could not read manifest: %v", err)
+	}
+	manifest := &Manifest{}
+	if err = json.Unmarshal(data, manifest); err != nil {
+		t.Fatalf("could not parse manifest: %v", err)
+	}
+	return manifest
+}
+
+func TestPartitionedSinkManifest(t *testing.T) {
+	dir := t.TempDir()
+	ctx := WithRunID(context.Background(), "run1")
+
+	sink, err := NewPartitionedSink(ctx, dir, FormatCSV, []string{"ticker", "year"}, "")
+	if err != nil {
+		t.Fatalf("NewPartitionedSink() error = %v", err)
+	}
+
+	results := []*AssetResult{
+		{Asset: &Asset{Ticker: "DGS10"}, Quotes: []*Eod{
+			partitionQuote("DGS10", "2021-12-30"),
+			partitionQuote("DGS10", "2021-12-31"),
+			partitionQuote("DGS10", "2022-01-03"),
+		}},
+		{Asset: &Asset{Ticker: "CPIAUCSL:pc1"}, Quotes: []*Eod{
+			partitionQuote("CPIAUCSL:pc1", "2022-02-01"),
+			partitionQuote("CPIAUCSL:pc1", "2022-01-01"),
+		}},
+	}
+	for _, result := range results {
+		if err = sink.Write(ctx, result); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+		if len(sink.open) != 0 {
+			t.Errorf("%d files open after writing %s, want 0", len(sink.open), result.Asset.Ticker)
+		}
+	}
+	if err = sink.Close(ctx); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	manifest := readManifest(t, filepath.Join(dir, "manifest-run1.json"))
+	if manifest.RunID != "run1" || manifest.Format != FormatCSV || manifest.SchemaVersion != EodSchemaVersion {
+		t.Errorf("manifest header = {%s %s %d}", manifest.RunID, manifest.Format, manifest.SchemaVersion)
+	}
+
+	want := []ManifestFile{
+		{Path: "ticker=CPIAUCSL%3Apc1/year=2022/part-run1-00002.csv", Partition: map[string]string{"ticker": "CPIAUCSL:pc1", "year": "2022"}, Rows: 2, MinDate: "2022-01-01", MaxDate: "2022-02-01"},
+		{Path: "ticker=DGS10/year=2021/part-run1-00000.csv", Partition: map[string]string{"ticker": "DGS10", "year": "2021"}, Rows: 2, MinDate: "2021-12-30", MaxDate: "2021-12-31"},
+		{Path: "ticker=DGS10/year=2022/part-run1-00001.csv", Partition: map[string]string{"ticker": "DGS10", "year": "2022"}, Rows: 1, MinDate: "2022-01-03", MaxDate: "2022-01-03"},
+	}
+	if len(manifest.Files) != len(want) {
+		t.Fatalf("manifest lists %d files, want %d", len(manifest.Files), len(want))
+	}
+
+	for idx, w := range want {
+		got := manifest.Files[idx]
+		if got.Path != w.Path || !reflect.DeepEqual(got.Partition, w.Partition) || got.Rows != w.Rows || got.MinDate != w.MinDate || got.MaxDate != w.MaxDate {
+			t.Errorf("file %d = %+v, want %+v", idx, *got, w)
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(got.Path)))
+		if err != nil {
+			t.Errorf("could not read %s: %v", got.Path, err)
+			continue
+		}
+		sum := sha256.Sum256(data)
+		if got.Bytes != int64(len(data)) || got.SHA256 != hex.EncodeToString(sum[:]) {
+			t.Errorf("file %s bytes, sha256 = %d, %s, want %d, %x", got.Path, got.Bytes, got.SHA256, len(data), sum)
+		}
+	}
+}
+
+func TestPartitionedSinkBoundsOpenFiles(t *testing.T) {
+	dir := t.TempDir()
+	ctx := WithRunID(context.Background(), "run1")
+
+	sink, err := NewPartitionedSink(ctx, dir, FormatCSV, []string{"year"}, "")
+	if err != nil {
+		t.Fatalf("NewPartitionedSink() error = %v", err)
+	}
+	sink.maxOpen = 2
+
+	// each asset spans three years; files stay open across assets
+	for _, ticker := range []string{"DGS10", "DGS3MO"} {
+		result := &AssetResult{Asset: &Asset{Ticker: ticker}, Quotes: []*Eod{
+			partitionQuote(ticker, "2020-06-01"),
+			partitionQuote(ticker, "2021-06-01"),
+			partitionQuote(ticker, "2022-06-01"),
+		}}
+		if err = sink.Write(ctx, result); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+		if len(sink.open) > sink.maxOpen {
+			t.Errorf("%d files open, want at most %d", len(sink.open), sink.maxOpen)
+		}
+	}
+	if err = sink.Close(ctx); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	manifest := readManifest(t, filepath.Join(dir, "manifest-run1.json"))
+
+	rows := map[string]int{}
+	total := 0
+	for _, file := range manifest.Files {
+		rows[file.Partition["year"]] += file.Rows
+		total += file.Rows
+	}
+	if total != 6 || rows["2020"] != 2 || rows["2021"] != 2 || rows["2022"] != 2 {
+		t.Errorf("rows by year = %v, want 2 per year", rows)
+	}
+
+	// 2020 is evicted by 2022, 2021 by 2020 and 2022 by 2021
+	if len(manifest.Files) != 6 {
+		paths := make([]string, 0, len(manifest.Files))
+		for _, file := range manifest.Files {
+			paths = append(paths, file.Path)
+		}
+		t.Errorf("manifest files = %v, want 6 parts", paths)
+	}
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fred
+
+import (
+	"context"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// numWorkers returns the configured size of the download worker pool
+func numWorkers() int {
+	workers := viper.GetInt("workers")
+	if workers < 1 {
+		workers = 1
+	}
+	return workers
+}
+
+// forEach calls fn for every index in [0, n) using at most workers
+// goroutines and returns once all calls have completed. Callers store
+// results by index to keep output ordering independent of scheduling.
+// Once ctx is done no further indexes are dispatched; calls already in
+// progress are allowed to finish.
+func forEach(ctx context.Context, n, workers int, fn func(idx int)) {
+	if workers > n {
+		workers = n
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				if ctx.Err() != nil {
+					continue
+				}
+				fn(idx)
+			}
+		}()
+	}
+
+dispatch:
+	for idx := 0; idx < n; idx++ {
+		select {
+		case jobs <- idx:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(jobs)
+
+	wg.Wait()
+}
@@ -0,0 +1,190 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fred
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+const (
+	PruneReasonDiscontinued = "discontinued"
+	PruneReasonStale        = "stale"
+)
+
+const assetDeactivationsTable = `CREATE TABLE IF NOT EXISTS asset_deactivations (
+	id BIGSERIAL PRIMARY KEY,
+	run_id TEXT NOT NULL,
+	composite_figi TEXT NOT NULL,
+	ticker TEXT NOT NULL,
+	reason TEXT NOT NULL,
+	title TEXT,
+	observation_end DATE,
+	deactivated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+)`
+
+const pruneQuery = `SELECT
+	assets.composite_figi,
+	assets.ticker,
+	assets.asset_type,
+	series_metadata.title,
+	series_metadata.frequency_short,
+	series_metadata.observation_end
+FROM assets
+JOIN series_metadata ON series_metadata.composite_figi = assets.composite_figi
+WHERE assets.asset_type = ANY($1) AND assets.active = 't'
+ORDER BY assets.ticker`
+
+// PruneCandidate is an active asset whose series is no longer published
+type PruneCandidate struct {
+	Asset          *Asset
+	Reason         string
+	Title          string
+	ObservationEnd time.Time
+}
+
+// frequencyInterval is the longest expected gap between observations for
+// each FRED frequency_short value
+var frequencyInterval = map[string]time.Duration{
+	"D":  4 * 24 * time.Hour, // allow for long weekends
+	"W":  7 * 24 * time.Hour,
+	"BW": 14 * 24 * time.Hour,
+	"M":  31 * 24 * time.Hour,
+	"Q":  92 * 24 * time.Hour,
+	"SA": 183 * 24 * time.Hour,
+	"A":  366 * 24 * time.Hour,
+}
+
+// pruneReason returns why a series should be deactivated or the empty
+// string if it is still current. A series is only pruned once its last
+// observation is older than its expected publication interval plus the
+// grace period.
+func pruneReason(title, frequencyShort string, observationEnd, now time.Time, grace time.Duration) string {
+	if observationEnd.IsZero() {
+		return ""
+	}
+
+	age := now.Sub(observationEnd)
+	if strings.Contains(strings.ToUpper(title), "DISCONTINUED") && age > grace {
+		return PruneReasonDiscontinued
+	}
+
+	interval, ok := frequencyInterval[strings.ToUpper(frequencyShort)]
+	if !ok {
+		interval = frequencyInterval["A"]
+	}
+	if age > interval+grace {
+		return PruneReasonStale
+	}
+
+	return ""
+}
+
+// FindPruneCandidates checks the stored series metadata of every active
+// asset of the given asset types and returns those that have been
+// discontinued or have stopped advancing for longer than the grace period.
+// Assets without stored metadata are never pruned.
+func FindPruneCandidates(ctx context.Context, assetTypes []string, grace time.Duration) ([]*PruneCandidate, error) {
+	conn, err := pgx.Connect(ctx, viper.GetString("database.url"))
+	if err != nil {
+		log.Error().Err(err).Msg("Could not connect to database")
+		return nil, err
+	}
+	defer conn.Close(ctx)
+
+	rows, err := conn.Query(ctx, pruneQuery, assetTypes)
+	if err != nil {
+		log.Error().Err(err).Msg("could not retrieve series metadata")
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	candidates := make([]*PruneCandidate, 0)
+	for rows.Next() {
+		var asset Asset
+		var title, frequencyShort *string
+		var observationEnd *time.Time
+		if err = rows.Scan(&asset.CompositeFigi, &asset.Ticker, &asset.AssetType, &title, &frequencyShort, &observationEnd); err != nil {
+			return nil, err
+		}
+
+		candidate := &PruneCandidate{Asset: &asset}
+		if title != nil {
+			candidate.Title = *title
+		}
+		if observationEnd != nil {
+			candidate.ObservationEnd = *observationEnd
+		}
+		freq := ""
+		if frequencyShort != nil {
+			freq = *frequencyShort
+		}
+
+		candidate.Reason = pruneReason(candidate.Title, freq, candidate.ObservationEnd, now, grace)
+		if candidate.Reason != "" {
+			candidates = append(candidates, candidate)
+		}
+	}
+
+	return candidates, rows.Err()
+}
+
+// Deactivate sets active to false for each candidate and records the
+// reason in the asset_deactivations table. Deactivated assets are no
+// longer downloaded or filled.
+func Deactivate(ctx context.Context, candidates []*PruneCandidate) error {
+	conn, err := pgx.Connect(ctx, viper.GetString("database.url"))
+	if err != nil {
+		log.Error().Err(err).Msg("Could not connect to database")
+		return err
+	}
+	defer conn.Close(ctx)
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("could not begin transaction")
+		return err
+	}
+	defer func() {
+		// no-op once the transaction has been committed
+		_ = tx.Rollback(context.WithoutCancel(ctx))
+	}()
+
+	for _, candidate := range candidates {
+		asset := candidate.Asset
+		if _, err = tx.Exec(ctx, `UPDATE assets SET active = 'f' WHERE composite_figi = $1 AND ticker = $2`,
+			asset.CompositeFigi, asset.Ticker); err != nil {
+			log.Error().Err(err).Str("Ticker", asset.Ticker).Msg("could not deactivate asset")
+			return err
+		}
+
+		if _, err = tx.Exec(ctx, `INSERT INTO asset_deactivations (run_id, composite_figi, ticker, reason, title, observation_end) VALUES ($1, $2, $3, $4, $5, $6)`,
+			RunID(ctx), asset.CompositeFigi, asset.Ticker, candidate.Reason, candidate.Title, nullTime(candidate.ObservationEnd)); err != nil {
+			log.Error().Err(err).Str("Ticker", asset.Ticker).Msg("could not record asset deactivation")
+			return err
+		}
+
+		log.Info().Str("Ticker", asset.Ticker).Str("Reason", candidate.Reason).Time("ObservationEnd", candidate.ObservationEnd).Msg("deactivated asset")
+	}
+
+	return tx.Commit(ctx)
+}
@@ -0,0 +1,72 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fred
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPruneReason(t *testing.T) {
+	now := time.Date(2024, 6, 30, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	grace := 90 * day
+	ago := func(d time.Duration) time.Time { return now.Add(-d) }
+
+	tests := []struct {
+		name           string
+		title          string
+		frequency      string
+		observationEnd time.Time
+		grace          time.Duration
+		want           string
+	}{
+		{"zero observation end", "10-Year Treasury", "D", time.Time{}, grace, ""},
+		{"zero observation end of a discontinued series", "DISCONTINUED Rate", "D", time.Time{}, grace, ""},
+
+		{"discontinued past grace", "3-Month LIBOR (DISCONTINUED)", "D", ago(91 * day), grace, PruneReasonDiscontinued},
+		{"discontinued lower case", "3-month libor (discontinued)", "M", ago(91 * day), grace, PruneReasonDiscontinued},
+		{"discontinued within grace", "3-Month LIBOR (DISCONTINUED)", "D", ago(89 * day), grace, ""},
+		{"discontinued without grace", "3-Month LIBOR (DISCONTINUED)", "A", ago(day), 0, PruneReasonDiscontinued},
+
+		{"daily current", "10-Year Treasury", "D", ago(3 * day), grace, ""},
+		{"daily within grace", "10-Year Treasury", "D", ago(93 * day), grace, ""},
+		{"daily stale", "10-Year Treasury", "D", ago(95 * day), grace, PruneReasonStale},
+		{"daily stale without grace", "10-Year Treasury", "D", ago(5 * day), 0, PruneReasonStale},
+		{"weekly within grace", "Claims", "W", ago(96 * day), grace, ""},
+		{"weekly stale", "Claims", "W", ago(98 * day), grace, PruneReasonStale},
+		{"monthly within grace", "CPI", "M", ago(120 * day), grace, ""},
+		{"monthly stale", "CPI", "M", ago(122 * day), grace, PruneReasonStale},
+		{"quarterly within grace", "GDP", "Q", ago(181 * day), grace, ""},
+		{"quarterly stale", "GDP", "Q", ago(183 * day), grace, PruneReasonStale},
+		{"semiannual stale", "Survey", "SA", ago(274 * day), grace, PruneReasonStale},
+		{"annual within grace", "Population", "A", ago(455 * day), grace, ""},
+		{"annual stale", "Population", "A", ago(457 * day), grace, PruneReasonStale},
+		{"lower case frequency", "CPI", "m", ago(122 * day), grace, PruneReasonStale},
+		{"unknown frequency uses annual", "Index", "WEF", ago(455 * day), grace, ""},
+		{"unknown frequency stale", "Index", "", ago(457 * day), grace, PruneReasonStale},
+		{"longer grace period", "CPI", "M", ago(122 * day), 180 * day, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := pruneReason(tt.title, tt.frequency, tt.observationEnd, now, tt.grace)
+			if got != tt.want {
+				t.Errorf("pruneReason() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fred
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// retryable reports whether the request that produced err should be
+// attempted again. Only network errors, truncated responses, rate limiting
+// and server errors are considered transient; decoding and validation
+// errors fail the same way on every attempt.
+func retryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode == http.StatusTooManyRequests || apiErr.StatusCode >= 500
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// parseRetryAfter decodes a Retry-After header given in either seconds or
+// as an http date
+func parseRetryAfter(val string) time.Duration {
+	if val == "" {
+		return 0
+	}
+
+	if secs, err := strconv.Atoi(val); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+
+	if dt, err := http.ParseTime(val); err == nil {
+		return time.Until(dt)
+	}
+
+	return 0
+}
+
+// backoff returns the jittered delay before the given retry attempt
+// (starting at 1). The delay doubles with each attempt up to maxBackoff
+// and is randomized between half and the full delay.
+func backoff(attempt int, initial, maxBackoff time.Duration) time.Duration {
+	delay := initial << (attempt - 1)
+	if delay <= 0 || delay > maxBackoff {
+		delay = maxBackoff
+	}
+
+	half := delay / 2
+	if half <= 0 {
+		return delay
+	}
+	return half + time.Duration(rand.Int63n(int64(half)))
+}
+
+// withRetry calls fn until it succeeds, returns a non-retryable error,
+// retry.max_retries is exhausted or ctx is done. It returns the number of
+// retries performed and the last error. When ctx ends while waiting to
+// retry, the error wraps ctx.Err() as well as the last error of fn.
+func withRetry(ctx context.Context, ticker string, fn func() error) (int, error) {
+	maxRetries := viper.GetInt("retry.max_retries")
+	initial := viper.GetDuration("retry.initial_backoff")
+	maxBackoff := viper.GetDuration("retry.max_backoff")
+
+	retries := 0
+	for {
+		err := fn()
+		if err == nil || retries >= maxRetries || !retryable(err) {
+			return retries, err
+		}
+
+		delay := backoff(retries+1, initial, maxBackoff)
+
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && apiErr.RetryAfter > delay {
+			delay = apiErr.RetryAfter
+		}
+
+		log.Warn().Err(err).Str("Ticker", ticker).Int("Retry", retries+1).Dur("Delay", delay).Msg("request failed; retrying")
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return retries, errors.Join(ctx.Err(), err)
+		}
+		retries++
+	}
+}
@@ -0,0 +1,189 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fred
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"rate limited", &APIError{StatusCode: http.StatusTooManyRequests}, true},
+		{"server error", &APIError{StatusCode: http.StatusBadGateway}, true},
+		{"bad request", &APIError{StatusCode: http.StatusBadRequest}, false},
+		{"wrapped api error", fmt.Errorf("download: %w", &APIError{StatusCode: http.StatusServiceUnavailable}), true},
+		{"network error", &url.Error{Op: "Get", URL: "http://fred", Err: &net.OpError{Op: "dial", Err: fmt.Errorf("connection refused")}}, true},
+		{"truncated response", fmt.Errorf("read body: %w", io.ErrUnexpectedEOF), true},
+		{"canceled", &url.Error{Op: "Get", URL: "http://fred", Err: context.Canceled}, false},
+		{"json decode", &json.SyntaxError{Offset: 1}, false},
+		{"unknown frequency", fmt.Errorf("%w: hourly", ErrUnknownFrequency), false},
+		{"missing api key", ErrMissingAPIKey, false},
+		{"not supported", ErrNotSupported, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := retryable(tt.err); got != tt.want {
+				t.Errorf("retryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		name string
+		val  string
+		min  time.Duration
+		max  time.Duration
+	}{
+		{"empty", "", 0, 0},
+		{"seconds", "120", 2 * time.Minute, 2 * time.Minute},
+		{"http date", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat), 50 * time.Second, time.Minute},
+		{"invalid", "soon", 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseRetryAfter(tt.val)
+			if got < tt.min || got > tt.max {
+				t.Errorf("parseRetryAfter(%q) = %v, want between %v and %v", tt.val, got, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	initial := 100 * time.Millisecond
+	maxBackoff := time.Second
+
+	tests := []struct {
+		attempt int
+		delay   time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		{80, time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("attempt %d", tt.attempt), func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				got := backoff(tt.attempt, initial, maxBackoff)
+				if got < tt.delay/2 || got >= tt.delay {
+					t.Fatalf("backoff(%d) = %v, want in [%v, %v)", tt.attempt, got, tt.delay/2, tt.delay)
+				}
+			}
+		})
+	}
+
+	if got := backoff(1, time.Nanosecond, time.Nanosecond); got != time.Nanosecond {
+		t.Errorf("backoff with a 1ns delay = %v, want 1ns", got)
+	}
+}
+
+func TestWithRetry(t *testing.T) {
+	viper.Set("retry.max_retries", 2)
+	viper.Set("retry.initial_backoff", time.Millisecond)
+	viper.Set("retry.max_backoff", time.Millisecond)
+	t.Cleanup(func() {
+		viper.Set("retry.max_retries", nil)
+		viper.Set("retry.initial_backoff", nil)
+		viper.Set("retry.max_backoff", nil)
+	})
+
+	transient := &APIError{StatusCode: http.StatusServiceUnavailable}
+	permanent := &APIError{StatusCode: http.StatusBadRequest}
+
+	tests := []struct {
+		name    string
+		errs    []error
+		calls   int
+		retries int
+		err     error
+	}{
+		{"succeeds", []error{nil}, 1, 0, nil},
+		{"succeeds after retrying", []error{transient, transient, nil}, 3, 2, nil},
+		{"retries exhausted", []error{transient, transient, transient, nil}, 3, 2, transient},
+		{"not retryable", []error{permanent, nil}, 1, 0, permanent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			retries, err := withRetry(context.Background(), "DGS10", func() error {
+				calls++
+				return tt.errs[calls-1]
+			})
+			if calls != tt.calls || retries != tt.retries {
+				t.Errorf("calls = %d, retries = %d, want %d and %d", calls, retries, tt.calls, tt.retries)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("withRetry() error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestWithRetryCanceledDuringBackoff(t *testing.T) {
+	viper.Set("retry.max_retries", 3)
+	viper.Set("retry.initial_backoff", time.Hour)
+	viper.Set("retry.max_backoff", time.Hour)
+	t.Cleanup(func() {
+		viper.Set("retry.max_retries", nil)
+		viper.Set("retry.initial_backoff", nil)
+		viper.Set("retry.max_backoff", nil)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	transient := &APIError{StatusCode: http.StatusServiceUnavailable}
+
+	calls := 0
+	retries, err := withRetry(ctx, "DGS10", func() error {
+		calls++
+		cancel()
+		return transient
+	})
+
+	if calls != 1 || retries != 0 {
+		t.Errorf("calls = %d, retries = %d, want 1 and 0", calls, retries)
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("withRetry() error = %v, want %v", err, context.Canceled)
+	}
+	if !errors.Is(err, transient) {
+		t.Errorf("withRetry() error = %v, want it to wrap %v", err, transient)
+	}
+}
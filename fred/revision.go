@@ -0,0 +1,201 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fred
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/rs/zerolog/log"
+)
+
+const eodRevisionsTable = `CREATE TABLE IF NOT EXISTS eod_revisions (
+	id BIGSERIAL PRIMARY KEY,
+	run_id TEXT NOT NULL,
+	composite_figi TEXT NOT NULL,
+	ticker TEXT NOT NULL,
+	event_date DATE NOT NULL,
+	old_value DOUBLE PRECISION,
+	new_value DOUBLE PRECISION,
+	detected_at TIMESTAMPTZ NOT NULL DEFAULT now()
+)`
+
+type runIDKey struct{}
+
+// NewRunID returns a unique identifier for an import run
+func NewRunID() string {
+	buf := make([]byte, 4)
+	if _, err := rand.Read(buf); err != nil {
+		log.Warn().Err(err).Msg("could not generate random run id suffix")
+	}
+	return time.Now().UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(buf)
+}
+
+// WithRunID returns a context that records runID on revisions saved with it
+func WithRunID(ctx context.Context, runID string) context.Context {
+	return context.WithValue(ctx, runIDKey{}, runID)
+}
+
+// RunID returns the run id stored in ctx or an empty string
+func RunID(ctx context.Context) string {
+	runID, _ := ctx.Value(runIDKey{}).(string)
+	return runID
+}
+
+// Revision is a change to a previously stored observation
+type Revision struct {
+	Ticker        string    `json:"ticker"`
+	CompositeFigi string    `json:"compositeFigi"`
+	Date          time.Time `json:"date"`
+	OldValue      float64   `json:"oldValue"`
+	NewValue      float64   `json:"newValue"`
+}
+
+type eodKey struct {
+	compositeFigi string
+	date          string
+}
+
+// sameValue reports whether stored is value as saved in eod. Until the eod
+// price columns are widened (see WidenEodPrices) they are real, so value
+// is stored rounded to single precision; the rounding is not a change.
+func sameValue(stored, value float64) bool {
+	return stored == value || stored == float64(float32(value))
+}
+
+// recordRevisions compares quotes with the values stored in eod and writes
+// each changed value to eod_revisions. Replacing a value created by Fill
+// and recomputing a derived series are not revisions.
+func recordRevisions(ctx context.Context, tx pgx.Tx, quotes []*Eod) ([]*Revision, error) {
+	observed := make([]*Eod, 0, len(quotes))
+	for _, quote := range quotes {
+		if quote.Exchange != ExchangeDerived {
+			observed = append(observed, quote)
+		}
+	}
+	quotes = observed
+
+	if len(quotes) == 0 {
+		return nil, nil
+	}
+
+	// the last quote for a date wins, matching the upsert
+	incoming := make(map[eodKey]*Eod, len(quotes))
+	figis := make([]string, 0)
+	seenFigi := make(map[string]bool)
+	minDate, maxDate := quotes[0].Date, quotes[0].Date
+	for _, quote := range quotes {
+		incoming[eodKey{quote.CompositeFigi, quote.Date}] = quote
+		if !seenFigi[quote.CompositeFigi] {
+			seenFigi[quote.CompositeFigi] = true
+			figis = append(figis, quote.CompositeFigi)
+		}
+		if quote.Date < minDate {
+			minDate = quote.Date
+		}
+		if quote.Date > maxDate {
+			maxDate = quote.Date
+		}
+	}
+
+	rows, err := tx.Query(ctx, `SELECT composite_figi, event_date, close FROM eod
+		WHERE composite_figi = ANY($1) AND event_date BETWEEN $2 AND $3 AND source IS DISTINCT FROM 'api.pennyvault.com'`,
+		figis, minDate, maxDate)
+	if err != nil {
+		return nil, err
+	}
+
+	revisions := make([]*Revision, 0)
+	for rows.Next() {
+		var figi string
+		var eventDate time.Time
+		var stored float64
+		if err = rows.Scan(&figi, &eventDate, &stored); err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		quote, ok := incoming[eodKey{figi, eventDate.Format("2006-01-02")}]
+		if !ok || sameValue(stored, quote.Close) {
+			continue
+		}
+
+		revisions = append(revisions, &Revision{
+			Ticker:        quote.Ticker,
+			CompositeFigi: figi,
+			Date:          eventDate,
+			OldValue:      stored,
+			NewValue:      quote.Close,
+		})
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(revisions) == 0 {
+		return revisions, nil
+	}
+
+	sort.Slice(revisions, func(i, j int) bool {
+		if revisions[i].Ticker != revisions[j].Ticker {
+			return revisions[i].Ticker < revisions[j].Ticker
+		}
+		return revisions[i].Date.Before(revisions[j].Date)
+	})
+
+	runID := RunID(ctx)
+	_, err = tx.CopyFrom(ctx, pgx.Identifier{"eod_revisions"},
+		[]string{"run_id", "composite_figi", "ticker", "event_date", "old_value", "new_value"},
+		pgx.CopyFromSlice(len(revisions), func(idx int) ([]interface{}, error) {
+			r := revisions[idx]
+			return []interface{}{runID, r.CompositeFigi, r.Ticker, r.Date, r.OldValue, r.NewValue}, nil
+		}))
+	if err != nil {
+		return nil, err
+	}
+
+	return revisions, nil
+}
+
+// logRevisions writes a per-series summary of revisions to the run log
+func logRevisions(revisions []*Revision) {
+	if len(revisions) == 0 {
+		log.Info().Msg("no revisions detected")
+		return
+	}
+
+	// revisions are sorted by ticker and date
+	for start := 0; start < len(revisions); {
+		end := start
+		for end < len(revisions) && revisions[end].Ticker == revisions[start].Ticker {
+			end++
+		}
+
+		log.Warn().
+			Str("Ticker", revisions[start].Ticker).
+			Int("NumRevised", end-start).
+			Time("FirstDate", revisions[start].Date).
+			Time("LastDate", revisions[end-1].Date).
+			Msg("series restated by source")
+
+		start = end
+	}
+}
@@ -0,0 +1,235 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fred
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+	"github.com/xitongsys/parquet-go/source"
+)
+
+const (
+	s3Scheme = "s3://"
+
+	// DefaultS3Endpoint is used when `s3.endpoint` is not configured
+	DefaultS3Endpoint = "s3.amazonaws.com"
+
+	// s3PartSize bounds the memory used per upload; objects may be up to
+	// 10,000 parts in size
+	s3PartSize = 16 * 1024 * 1024
+)
+
+var (
+	ErrInvalidS3URL = errors.New("invalid s3 url")
+	errWriteOnly    = errors.New("s3 file is write-only")
+)
+
+// IsS3URL reports whether fn refers to an object in an S3-compatible
+// bucket, e.g. s3://bucket/prefix/eod.parquet
+func IsS3URL(fn string) bool {
+	return strings.HasPrefix(fn, s3Scheme)
+}
+
+// parseS3URL splits s3://bucket/key into its bucket and key
+func parseS3URL(fn string) (bucket, key string, err error) {
+	bucket, key, _ = strings.Cut(strings.TrimPrefix(fn, s3Scheme), "/")
+	if bucket == "" || key == "" || strings.HasSuffix(key, "/") {
+		return "", "", fmt.Errorf("%w: %s", ErrInvalidS3URL, fn)
+	}
+	return bucket, key, nil
+}
+
+// NewS3ClientFromConfig creates a client for the S3-compatible service at
+// `s3.endpoint` (AWS, Backblaze B2, MinIO, ...). Credentials are taken from
+// `s3.access_key_id` and `s3.secret_access_key` (or S3_ACCESS_KEY_ID and
+// S3_SECRET_ACCESS_KEY) and otherwise from the standard AWS and MinIO
+// environment variables, the AWS credentials file or the instance role.
+func NewS3ClientFromConfig() (*minio.Client, error) {
+	endpoint := viper.GetString("s3.endpoint")
+	if endpoint == "" {
+		endpoint = DefaultS3Endpoint
+	}
+
+	secure := true
+	if viper.IsSet("s3.use_ssl") {
+		secure = viper.GetBool("s3.use_ssl")
+	}
+
+	// the endpoint may be given as a url
+	if rest, ok := strings.CutPrefix(endpoint, "https://"); ok {
+		endpoint = rest
+	} else if rest, ok := strings.CutPrefix(endpoint, "http://"); ok {
+		endpoint = rest
+		secure = false
+	}
+
+	creds := credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.Static{Value: credentials.Value{
+			AccessKeyID:     viper.GetString("s3.access_key_id"),
+			SecretAccessKey: viper.GetString("s3.secret_access_key"),
+			SignerType:      credentials.SignatureV4,
+		}},
+		&credentials.EnvAWS{},
+		&credentials.EnvMinio{},
+		&credentials.FileAWSCredentials{},
+		&credentials.IAM{},
+	})
+
+	return minio.New(strings.TrimSuffix(endpoint, "/"), &minio.Options{
+		Creds:  creds,
+		Secure: secure,
+		Region: viper.GetString("s3.region"),
+	})
+}
+
+// s3File streams a file to an S3-compatible bucket with a multipart
+// upload. The data is uploaded to a temporary key and only copied to its
+// final key once the upload has completed, so readers never see a partial
+// file.
+type s3File struct {
+	ctx         context.Context
+	client      *minio.Client
+	bucket      string
+	key         string
+	tmpKey      string
+	contentType string
+
+	pw   *io.PipeWriter
+	done chan error
+}
+
+// newS3FileWriter starts uploading to the object fn (s3://bucket/key) a
+// file written in format
+func newS3FileWriter(ctx context.Context, fn, format string) (*s3File, error) {
+	bucket, key, err := parseS3URL(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := NewS3ClientFromConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	runID := RunID(ctx)
+	if runID == "" {
+		runID = NewRunID()
+	}
+
+	// the upload is completed even when the run is interrupted so that the
+	// records written so far are published
+	ctx = context.WithoutCancel(ctx)
+
+	pr, pw := io.Pipe()
+	f := &s3File{
+		ctx:    ctx,
+		client: client,
+		bucket: bucket,
+		key:    key,
+		tmpKey: key + ".tmp-" + runID,
+		pw:     pw,
+		done:   make(chan error, 1),
+	}
+
+	contentType, ok := formatContentTypes[format]
+	if !ok {
+		contentType = "application/octet-stream"
+	}
+	f.contentType = contentType
+
+	go func() {
+		_, err := client.PutObject(ctx, bucket, f.tmpKey, pr, -1, minio.PutObjectOptions{
+			ContentType: contentType,
+			PartSize:    s3PartSize,
+		})
+		// unblock the writer if the upload stopped early
+		pr.CloseWithError(err)
+		f.done <- err
+	}()
+
+	return f, nil
+}
+
+func (f *s3File) Write(p []byte) (int, error) {
+	return f.pw.Write(p)
+}
+
+// Close completes the upload and publishes the object under its final key
+func (f *s3File) Close() error {
+	if err := f.pw.Close(); err != nil {
+		return err
+	}
+
+	if err := <-f.done; err != nil {
+		log.Error().Err(err).Str("Bucket", f.bucket).Str("Key", f.tmpKey).Msg("s3 upload failed")
+		return err
+	}
+
+	// a single CopyObject is limited to 5 GiB; ComposeObject copies larger
+	// objects part by part. The multipart copy does not carry over the
+	// content type of the source, so it is set again.
+	_, err := f.client.ComposeObject(f.ctx,
+		minio.CopyDestOptions{
+			Bucket:          f.bucket,
+			Object:          f.key,
+			ReplaceMetadata: true,
+			UserMetadata:    map[string]string{"Content-Type": f.contentType},
+		},
+		minio.CopySrcOptions{Bucket: f.bucket, Object: f.tmpKey})
+	if err != nil {
+		log.Error().Err(err).Str("Bucket", f.bucket).Str("Key", f.key).Msg("could not publish s3 object")
+		return err
+	}
+
+	if err = f.client.RemoveObject(f.ctx, f.bucket, f.tmpKey, minio.RemoveObjectOptions{}); err != nil {
+		log.Warn().Err(err).Str("Bucket", f.bucket).Str("Key", f.tmpKey).Msg("could not remove temporary s3 object")
+	}
+
+	log.Info().Str("Bucket", f.bucket).Str("Key", f.key).Msg("published s3 object")
+	return nil
+}
+
+// Abort stops the upload without publishing the object
+func (f *s3File) Abort(cause error) {
+	f.pw.CloseWithError(cause)
+	<-f.done
+}
+
+// s3File is write-only
+
+func (f *s3File) Read(p []byte) (int, error) {
+	return 0, errWriteOnly
+}
+
+func (f *s3File) Seek(offset int64, whence int) (int64, error) {
+	return 0, errWriteOnly
+}
+
+func (f *s3File) Open(name string) (source.ParquetFile, error) {
+	return nil, errWriteOnly
+}
+
+func (f *s3File) Create(name string) (source.ParquetFile, error) {
+	return nil, errWriteOnly
+}
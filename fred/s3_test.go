@@ -0,0 +1,364 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fred
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// fakeS3 is an in-process S3 server that supports the requests made by
+// s3File: multipart uploads, server-side copies (whole objects and
+// multipart copies by range), object stats and deletes
+type fakeS3 struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	uploads  map[string]map[int][]byte
+	uploadID int
+
+	// contentTypes are the content types the objects were uploaded with
+	contentTypes map[string]string
+
+	// copies maps the destination of each server-side copy to its source
+	copies map[string]string
+
+	// copyParts counts the parts copied by multipart copies
+	copyParts int
+}
+
+func newFakeS3(t *testing.T) *fakeS3 {
+	t.Helper()
+
+	fake := &fakeS3{
+		objects:      make(map[string][]byte),
+		uploads:      make(map[string]map[int][]byte),
+		contentTypes: make(map[string]string),
+		copies:       make(map[string]string),
+	}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	for key, value := range map[string]string{
+		"s3.endpoint":          srv.URL,
+		"s3.region":            "us-east-1",
+		"s3.access_key_id":     "test",
+		"s3.secret_access_key": "testsecret",
+	} {
+		viper.Set(key, value)
+		key := key
+		t.Cleanup(func() { viper.Set(key, nil) })
+	}
+
+	return fake
+}
+
+// keys returns the stored objects as bucket/key paths
+func (f *fakeS3) keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	keys := make([]string, 0, len(f.objects))
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *fakeS3) object(key string) ([]byte, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, ok := f.objects[key]
+	return data, ok
+}
+
+func (f *fakeS3) pendingUploads() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.uploads)
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	query := r.URL.Query()
+
+	body, err := readS3Body(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodHead:
+		data, ok := f.objects[path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Content-Type", f.contentTypes[path])
+		w.Header().Set("ETag", `"object"`)
+		w.Header().Set("Last-Modified", "Sat, 01 Jan 2022 00:00:00 GMT")
+
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.uploadID++
+		id := strconv.Itoa(f.uploadID)
+		f.uploads[id] = make(map[int][]byte)
+		f.contentTypes[path] = r.Header.Get("Content-Type")
+		bucket, key, _ := strings.Cut(path, "/")
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>", bucket, key, id)
+
+	case r.Method == http.MethodPut && query.Has("partNumber") && r.Header.Get("X-Amz-Copy-Source") != "":
+		parts, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			http.Error(w, "no such upload", http.StatusNotFound)
+			return
+		}
+		src, _ := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+		src = strings.TrimPrefix(src, "/")
+		data, ok := f.objects[src]
+		if !ok {
+			http.Error(w, "no such key", http.StatusNotFound)
+			return
+		}
+		var start, end int
+		if _, err = fmt.Sscanf(r.Header.Get("X-Amz-Copy-Source-Range"), "bytes=%d-%d", &start, &end); err != nil || end >= len(data) {
+			http.Error(w, "invalid range", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		partNumber, _ := strconv.Atoi(query.Get("partNumber"))
+		parts[partNumber] = data[start : end+1]
+		f.copies[path] = src
+		f.copyParts++
+		fmt.Fprintf(w, `<CopyPartResult><ETag>"part-%d"</ETag><LastModified>2022-01-01T00:00:00.000Z</LastModified></CopyPartResult>`, partNumber)
+
+	case r.Method == http.MethodPut && query.Has("partNumber"):
+		parts, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			http.Error(w, "no such upload", http.StatusNotFound)
+			return
+		}
+		partNumber, _ := strconv.Atoi(query.Get("partNumber"))
+		parts[partNumber] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"part-%d"`, partNumber))
+
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		parts, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			http.Error(w, "no such upload", http.StatusNotFound)
+			return
+		}
+		numbers := make([]int, 0, len(parts))
+		for number := range parts {
+			numbers = append(numbers, number)
+		}
+		sort.Ints(numbers)
+		var data []byte
+		for _, number := range numbers {
+			data = append(data, parts[number]...)
+		}
+		f.objects[path] = data
+		delete(f.uploads, query.Get("uploadId"))
+		bucket, key, _ := strings.Cut(path, "/")
+		fmt.Fprintf(w, `<CompleteMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><ETag>"complete"</ETag></CompleteMultipartUploadResult>`, bucket, key)
+
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		src, _ := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+		data, ok := f.objects[strings.TrimPrefix(src, "/")]
+		if !ok {
+			http.Error(w, "no such key", http.StatusNotFound)
+			return
+		}
+		f.objects[path] = data
+		f.copies[path] = strings.TrimPrefix(src, "/")
+		if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+			f.contentTypes[path] = r.Header.Get("Content-Type")
+		}
+		fmt.Fprint(w, `<CopyObjectResult><ETag>"copy"</ETag><LastModified>2022-01-01T00:00:00.000Z</LastModified></CopyObjectResult>`)
+
+	case r.Method == http.MethodPut:
+		f.objects[path] = body
+		f.contentTypes[path] = r.Header.Get("Content-Type")
+		w.Header().Set("ETag", `"object"`)
+
+	case r.Method == http.MethodDelete:
+		delete(f.objects, path)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "unsupported request", http.StatusNotImplemented)
+	}
+}
+
+// readS3Body reads the request body, decoding the aws-chunked encoding
+// used for signed uploads over plain http
+func readS3Body(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return io.ReadAll(r.Body)
+	}
+
+	var data []byte
+	br := bufio.NewReader(r.Body)
+	for {
+		header, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		sizeHex, _, _ := strings.Cut(strings.TrimSpace(header), ";")
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return data, nil
+		}
+
+		chunk := make([]byte, size+2) // data followed by \r\n
+		if _, err = io.ReadFull(br, chunk); err != nil {
+			return nil, err
+		}
+		data = append(data, chunk[:size]...)
+	}
+}
+
+func TestS3FilePublishesOnClose(t *testing.T) {
+	fake := newFakeS3(t)
+	ctx := WithRunID(context.Background(), "run1")
+
+	file, err := createOutputFile(ctx, "s3://bucket/fred/eod.csv", FormatCSV)
+	if err != nil {
+		t.Fatalf("createOutputFile() error = %v", err)
+	}
+
+	if err = file.write(quotesOn("2022-01-03", "2022-01-04")); err != nil {
+		t.Fatalf("write() error = %v", err)
+	}
+	if keys := fake.keys(); len(keys) != 0 {
+		t.Fatalf("objects before Close = %v, want none", keys)
+	}
+
+	if err = file.close(); err != nil {
+		t.Fatalf("close() error = %v", err)
+	}
+
+	if keys := fake.keys(); len(keys) != 1 || keys[0] != "bucket/fred/eod.csv" {
+		t.Errorf("objects after Close = %v, want [bucket/fred/eod.csv]", keys)
+	}
+	if src := fake.copies["bucket/fred/eod.csv"]; src != "bucket/fred/eod.csv.tmp-run1" {
+		t.Errorf("published from %q, want bucket/fred/eod.csv.tmp-run1", src)
+	}
+	// a multipart copy publishes objects larger than the 5 GiB copy limit
+	if fake.copyParts == 0 {
+		t.Error("object was not published with a multipart copy")
+	}
+	if _, ok := fake.object("bucket/fred/eod.csv.tmp-run1"); ok {
+		t.Error("temporary object bucket/fred/eod.csv.tmp-run1 was not removed")
+	}
+	if n := fake.pendingUploads(); n != 0 {
+		t.Errorf("pending uploads = %d, want 0", n)
+	}
+
+	data, _ := fake.object("bucket/fred/eod.csv")
+	rows, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		t.Fatalf("published object is not csv: %v", err)
+	}
+	if len(rows) != 3 || rows[1][0] != "2022-01-03" || rows[2][0] != "2022-01-04" {
+		t.Errorf("published rows = %v, want a header and 2022-01-03, 2022-01-04", rows)
+	}
+}
+
+func TestS3FileContentType(t *testing.T) {
+	tests := []struct {
+		format      string
+		contentType string
+	}{
+		{FormatParquet, "application/vnd.apache.parquet"},
+		{FormatCSV, "text/csv"},
+		{FormatNDJSON, "application/x-ndjson"},
+		{FormatArrow, "application/vnd.apache.arrow.file"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			fake := newFakeS3(t)
+			ctx := WithRunID(context.Background(), "run1")
+
+			file, err := createOutputFile(ctx, "s3://bucket/eod"+FormatExtension(tt.format), tt.format)
+			if err != nil {
+				t.Fatalf("createOutputFile() error = %v", err)
+			}
+			if err = file.write(quotesOn("2022-01-03")); err != nil {
+				t.Fatalf("write() error = %v", err)
+			}
+			if err = file.close(); err != nil {
+				t.Fatalf("close() error = %v", err)
+			}
+
+			key := "bucket/eod" + FormatExtension(tt.format)
+			for _, key := range []string{key + ".tmp-run1", key} {
+				if got := fake.contentTypes[key]; got != tt.contentType {
+					t.Errorf("content type of %s = %q, want %q", key, got, tt.contentType)
+				}
+			}
+		})
+	}
+}
+
+func TestS3FileAbort(t *testing.T) {
+	fake := newFakeS3(t)
+	ctx := WithRunID(context.Background(), "run1")
+
+	file, err := createOutputFile(ctx, "s3://bucket/fred/eod.csv", FormatCSV)
+	if err != nil {
+		t.Fatalf("createOutputFile() error = %v", err)
+	}
+
+	if err = file.write(quotesOn("2022-01-03", "2022-01-04")); err != nil {
+		t.Fatalf("write() error = %v", err)
+	}
+
+	abortFile(file.fh, errors.New("run failed"))
+
+	if keys := fake.keys(); len(keys) != 0 {
+		t.Errorf("objects after Abort = %v, want none", keys)
+	}
+	if n := fake.pendingUploads(); n != 0 {
+		t.Errorf("pending uploads = %d, want 0", n)
+	}
+}
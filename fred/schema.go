@@ -0,0 +1,176 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fred
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// schemaColumn is a column added to a table that import-fred does not
+// create itself
+type schemaColumn struct {
+	table  string
+	column string
+	ddl    string
+}
+
+// schemaTables are the tables owned by import-fred
+var schemaTables = []struct {
+	name string
+	ddl  string
+}{
+	{"series_metadata", seriesMetadataTable},
+	{"eod_revisions", eodRevisionsTable},
+	{"eod_vintage", eodVintageTable},
+	{"asset_deactivations", assetDeactivationsTable},
+}
+
+// schemaColumns are added to existing tables. ALTER TABLE takes an ACCESS
+// EXCLUSIVE lock even when the column already exists, so each column is
+// only altered when it is missing.
+var schemaColumns = []schemaColumn{
+	{"eod", "frequency", eodFrequencyColumn},
+	{"series_metadata", "transformation", seriesMetadataTransformation},
+}
+
+// eodPriceColumns are the columns of eod that hold observed values
+var eodPriceColumns = []string{"open", "high", "low", "close", "dividend", "split_factor"}
+
+// Migrate creates the tables and columns import-fred writes to. It should
+// be run once at startup, before any quotes, metadata, vintages or
+// deactivations are saved; the save functions do not change the schema.
+//
+// eod is shared with the other importers, so Migrate does not change the
+// type of its price columns; when they are still stored as real it logs
+// a warning and WidenEodPrices must be run explicitly.
+func Migrate(ctx context.Context) error {
+	conn, err := pgx.Connect(ctx, viper.GetString("database.url"))
+	if err != nil {
+		log.Error().Err(err).Msg("Could not connect to database")
+		return err
+	}
+	defer conn.Close(ctx)
+
+	for _, table := range schemaTables {
+		if _, err = conn.Exec(ctx, table.ddl); err != nil {
+			log.Error().Err(err).Str("Table", table.name).Msg("could not create table")
+			return err
+		}
+	}
+
+	for _, col := range schemaColumns {
+		exists, err := columnExists(ctx, conn, col.table, col.column)
+		if err != nil {
+			log.Error().Err(err).Str("Table", col.table).Str("Column", col.column).Msg("could not inspect table")
+			return err
+		}
+		if exists {
+			continue
+		}
+
+		if _, err = conn.Exec(ctx, col.ddl); err != nil {
+			log.Error().Err(err).Str("Table", col.table).Str("Column", col.column).Msg("could not add column")
+			return err
+		}
+		log.Info().Str("Table", col.table).Str("Column", col.column).Msg("added column")
+	}
+
+	columns, err := realEodPrices(ctx, conn)
+	if err != nil {
+		log.Error().Err(err).Msg("could not inspect eod price columns")
+		return err
+	}
+	if len(columns) > 0 {
+		log.Warn().Strs("Columns", columns).Msg("eod price columns are stored as real and round observations; run `import-fred migrate --widen-eod` to store them in double precision")
+	}
+
+	return nil
+}
+
+// WidenEodPrices changes the price columns of eod that are stored as real
+// to double precision. The change rewrites eod under an ACCESS EXCLUSIVE
+// lock that blocks every other reader and writer of the table until it
+// completes, so it is only made when requested and only while a column
+// still has the old type.
+func WidenEodPrices(ctx context.Context) error {
+	conn, err := pgx.Connect(ctx, viper.GetString("database.url"))
+	if err != nil {
+		log.Error().Err(err).Msg("Could not connect to database")
+		return err
+	}
+	defer conn.Close(ctx)
+
+	columns, err := realEodPrices(ctx, conn)
+	if err != nil {
+		log.Error().Err(err).Msg("could not inspect eod price columns")
+		return err
+	}
+	if len(columns) == 0 {
+		log.Info().Msg("eod price columns are already stored in double precision")
+		return nil
+	}
+
+	alter := make([]string, len(columns))
+	for idx, column := range columns {
+		alter[idx] = fmt.Sprintf("ALTER COLUMN %s TYPE double precision", pgx.Identifier{column}.Sanitize())
+	}
+	if _, err = conn.Exec(ctx, `ALTER TABLE eod `+strings.Join(alter, ", ")); err != nil {
+		log.Error().Err(err).Msg("could not change eod price columns to double precision")
+		return err
+	}
+
+	log.Info().Strs("Columns", columns).Msg("changed eod price columns to double precision")
+	return nil
+}
+
+// realEodPrices returns the price columns of eod that are stored as real.
+// It only reads the catalog and takes no locks on eod.
+func realEodPrices(ctx context.Context, conn *pgx.Conn) ([]string, error) {
+	rows, err := conn.Query(ctx, `SELECT column_name FROM information_schema.columns
+		WHERE table_name = 'eod' AND column_name = ANY($1) AND data_type = 'real' AND table_schema = ANY(current_schemas(false))`,
+		eodPriceColumns)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := make([]string, 0, len(eodPriceColumns))
+	for rows.Next() {
+		var column string
+		if err = rows.Scan(&column); err != nil {
+			return nil, err
+		}
+		columns = append(columns, column)
+	}
+
+	return columns, rows.Err()
+}
+
+// columnExists reports whether table has the given column. It only reads
+// the catalog and takes no locks on table.
+func columnExists(ctx context.Context, conn *pgx.Conn, table, column string) (bool, error) {
+	var exists bool
+	err := conn.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM information_schema.columns
+		WHERE table_name = $1 AND column_name = $2 AND table_schema = ANY(current_schemas(false)))`,
+		table, column).Scan(&exists)
+	return exists, err
+}
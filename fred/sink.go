@@ -0,0 +1,306 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fred
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// Sink receives the observations of each asset as soon as the asset has
+// been downloaded. Backfilled assets are written one chunk at a time.
+type Sink interface {
+	// Write saves the quotes and vintages of a downloaded asset
+	Write(ctx context.Context, result *AssetResult) error
+
+	// Close flushes any buffered output and releases the sink
+	Close(ctx context.Context) error
+}
+
+// MultiSink writes each result to every sink in order
+type MultiSink []Sink
+
+func (m MultiSink) Write(ctx context.Context, result *AssetResult) error {
+	var errs []error
+	for _, sink := range m {
+		if err := sink.Write(ctx, result); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m MultiSink) Close(ctx context.Context) error {
+	var errs []error
+	for _, sink := range m {
+		if err := sink.Close(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// FileSink appends quotes to a single file. The file is only complete once
+// Close has been called.
+type FileSink struct {
+	file *outputFile
+}
+
+// NewFileSink creates the file fn, which may be an s3://bucket/key url. When
+// format is empty it is chosen by the extension of fn (see OutputFormat).
+func NewFileSink(ctx context.Context, fn, format string) (*FileSink, error) {
+	format, err := OutputFormat(format, fn)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := createOutputFile(ctx, fn, format)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{file: file}, nil
+}
+
+func (s *FileSink) Write(ctx context.Context, result *AssetResult) error {
+	return s.file.write(result.Quotes)
+}
+
+// Close finishes the file and closes it
+func (s *FileSink) Close(ctx context.Context) error {
+	if err := s.file.close(); err != nil {
+		return err
+	}
+
+	log.Info().Int("NumRecords", s.file.numRecords).Str("FileName", s.file.fn).Msg("write finished")
+	return nil
+}
+
+// DatabaseSink saves the quotes of each result (an asset or a backfilled
+// chunk) to eod in its own transaction over a single connection. In
+// vintage mode the vintages are saved to eod_vintage as well.
+type DatabaseSink struct {
+	conn       *pgx.Conn
+	vintages   bool
+	total      SaveResult
+	numRevised int
+}
+
+// NewDatabaseSink connects to the database; the tables quotes are saved to
+// must have been created with Migrate
+func NewDatabaseSink(ctx context.Context) (*DatabaseSink, error) {
+	conn, err := pgx.Connect(ctx, viper.GetString("database.url"))
+	if err != nil {
+		log.Error().Err(err).Msg("Could not connect to database")
+		return nil, err
+	}
+
+	return &DatabaseSink{conn: conn, vintages: vintageMode()}, nil
+}
+
+func (s *DatabaseSink) Write(ctx context.Context, result *AssetResult) error {
+	if len(result.Quotes) > 0 {
+		saved, err := saveQuotes(ctx, s.conn, result.Quotes)
+		if err != nil {
+			return fmt.Errorf("save quotes: %w", err)
+		}
+
+		s.total.Inserted += saved.Inserted
+		s.total.Updated += saved.Updated
+		s.total.Unchanged += saved.Unchanged
+		s.numRevised += len(saved.Revisions)
+		if len(saved.Revisions) > 0 {
+			logRevisions(saved.Revisions)
+		}
+	}
+
+	if s.vintages && len(result.Vintages) > 0 {
+		if err := saveVintages(ctx, s.conn, result.Vintages); err != nil {
+			return fmt.Errorf("save vintages: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Close logs the totals of all writes and closes the connection
+func (s *DatabaseSink) Close(ctx context.Context) error {
+	log.Info().Int("Inserted", s.total.Inserted).Int("Updated", s.total.Updated).Int("Unchanged", s.total.Unchanged).Int("Revised", s.numRevised).Msg("saved to database")
+	return s.conn.Close(ctx)
+}
+
+// stream starts writing the results passed to emit to sink in asset
+// order, so that the output does not depend on which worker finishes
+// first. Every started asset must be emitted exactly once with its index;
+// before that, partial results carrying part of its observations may be
+// emitted with the same index and are written in the order they were
+// emitted. Results that failed without any observations are not written.
+// At most one result per worker is held back waiting for an earlier
+// asset, and observations are released once written. A result whose
+// write fails, or whose partial results failed to be written, is marked as
+// failed. The returned wait function writes the remaining results and
+// waits for the sink to finish.
+//
+// Writes are not canceled with ctx so that every downloaded asset is
+// saved. Assets that are skipped after ctx is done leave gaps in the
+// sequence; the results after a gap are written when wait is called.
+func stream(ctx context.Context, sink Sink) (emit func(idx int, result *AssetResult), wait func()) {
+	s := &orderedStream{
+		ctx:      ctx,
+		limit:    numWorkers(),
+		pending:  make(map[int][]*AssetResult),
+		finished: make(map[int]bool),
+		ready:    make(chan *AssetResult, numWorkers()),
+	}
+	s.cond = sync.NewCond(&s.mu)
+
+	// wake emitters waiting for an asset that will never be started
+	stop := context.AfterFunc(ctx, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.cond.Broadcast()
+	})
+
+	done := make(chan struct{})
+	writeCtx := context.WithoutCancel(ctx)
+
+	go func() {
+		defer close(done)
+
+		// the first write error of the partial results of each asset
+		partialErrs := make(map[*Asset]error)
+		for result := range s.ready {
+			err := writeResult(writeCtx, sink, result)
+			if result.Partial {
+				if err != nil && partialErrs[result.Asset] == nil {
+					partialErrs[result.Asset] = err
+				}
+				continue
+			}
+
+			if err == nil {
+				err = partialErrs[result.Asset]
+			}
+			delete(partialErrs, result.Asset)
+			if err != nil && result.Err == nil {
+				result.Err = err
+			}
+		}
+	}()
+
+	return s.emit, func() {
+		stop()
+		s.close()
+		<-done
+	}
+}
+
+// writeResult writes result to sink and releases its observations
+func writeResult(ctx context.Context, sink Sink, result *AssetResult) error {
+	if result.Failed() && len(result.Quotes) == 0 && len(result.Vintages) == 0 {
+		return nil
+	}
+
+	err := sink.Write(ctx, result)
+	if err != nil {
+		log.Error().Err(err).Str("Ticker", result.Asset.Ticker).Msg("could not save asset")
+	}
+	result.Quotes = nil
+	result.Vintages = nil
+	return err
+}
+
+// orderedStream is the reorder buffer of stream
+type orderedStream struct {
+	ctx  context.Context
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	// next is the index of the next asset to be written
+	next  int
+	limit int
+
+	// pending holds the results of later assets until next reaches them;
+	// numPending counts them across all assets
+	pending    map[int][]*AssetResult
+	numPending int
+
+	// finished marks the assets whose final result has been emitted
+	finished map[int]bool
+	ready    chan *AssetResult
+}
+
+// emit queues result, blocking while the buffer is full and result does
+// not belong to the next asset to be written
+func (s *orderedStream) emit(idx int, result *AssetResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for idx != s.next && s.numPending >= s.limit && s.ctx.Err() == nil {
+		s.cond.Wait()
+	}
+
+	if idx == s.next {
+		s.ready <- result
+	} else {
+		s.pending[idx] = append(s.pending[idx], result)
+		s.numPending++
+	}
+
+	if !result.Partial {
+		s.finished[idx] = true
+	}
+
+	for s.finished[s.next] {
+		delete(s.finished, s.next)
+		s.next++
+
+		// results emitted before their asset was next are written now
+		for _, next := range s.pending[s.next] {
+			s.ready <- next
+		}
+		s.numPending -= len(s.pending[s.next])
+		delete(s.pending, s.next)
+	}
+	s.cond.Broadcast()
+}
+
+// close writes the results still held back in index order and closes the
+// ready channel
+func (s *orderedStream) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	indexes := make([]int, 0, len(s.pending))
+	for idx := range s.pending {
+		indexes = append(indexes, idx)
+	}
+	sort.Ints(indexes)
+
+	for _, idx := range indexes {
+		for _, result := range s.pending[idx] {
+			s.ready <- result
+		}
+	}
+	s.pending = nil
+	close(s.ready)
+}
@@ -0,0 +1,247 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fred
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// recordingSink records the tickers of the results written to it
+type recordingSink struct {
+	mu      sync.Mutex
+	tickers []string
+}
+
+func (s *recordingSink) Write(ctx context.Context, result *AssetResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tickers = append(s.tickers, result.Asset.Ticker)
+	return nil
+}
+
+func (s *recordingSink) Close(ctx context.Context) error {
+	return nil
+}
+
+func streamResults(tickers ...string) []*AssetResult {
+	results := make([]*AssetResult, len(tickers))
+	for idx, ticker := range tickers {
+		results[idx] = &AssetResult{Asset: &Asset{Ticker: ticker}, Quotes: quotesOn("2022-01-03")}
+	}
+	return results
+}
+
+func TestStreamWritesInAssetOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		workers int
+		order   []int
+	}{
+		{"in order", 1, []int{0, 1, 2, 3}},
+		{"reversed", 3, []int{3, 2, 1, 0}},
+		{"interleaved", 1, []int{1, 0, 3, 2, 5, 4}},
+		{"last first", 5, []int{5, 1, 2, 3, 4, 0}},
+	}
+
+	t.Cleanup(func() { viper.Set("workers", nil) })
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			viper.Set("workers", tt.workers)
+
+			tickers := []string{"A", "B", "C", "D", "E", "F"}[:len(tt.order)]
+			results := streamResults(tickers...)
+			sink := &recordingSink{}
+
+			emit, wait := stream(context.Background(), sink)
+			for _, idx := range tt.order {
+				emit(idx, results[idx])
+			}
+			wait()
+
+			if !reflect.DeepEqual(sink.tickers, tickers) {
+				t.Errorf("sink saw %v, want %v", sink.tickers, tickers)
+			}
+		})
+	}
+}
+
+func TestStreamBoundsPendingResults(t *testing.T) {
+	viper.Set("workers", 2)
+	t.Cleanup(func() { viper.Set("workers", nil) })
+
+	results := streamResults("A", "B", "C", "D")
+	sink := &recordingSink{}
+
+	emit, wait := stream(context.Background(), sink)
+	emit(1, results[1])
+	emit(2, results[2])
+
+	emitted := make(chan struct{})
+	go func() {
+		emit(3, results[3])
+		close(emitted)
+	}()
+
+	select {
+	case <-emitted:
+		t.Fatal("emit did not wait for the buffered results to be written")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	emit(0, results[0])
+	<-emitted
+	wait()
+
+	if want := []string{"A", "B", "C", "D"}; !reflect.DeepEqual(sink.tickers, want) {
+		t.Errorf("sink saw %v, want %v", sink.tickers, want)
+	}
+}
+
+func TestStreamConcurrentWorkers(t *testing.T) {
+	viper.Set("workers", 4)
+	t.Cleanup(func() { viper.Set("workers", nil) })
+
+	tickers := make([]string, 100)
+	for idx := range tickers {
+		tickers[idx] = string(rune('A'+idx%26)) + string(rune('a'+idx/26))
+	}
+	results := streamResults(tickers...)
+	sink := &recordingSink{}
+
+	emit, wait := stream(context.Background(), sink)
+	forEach(context.Background(), len(results), 4, func(idx int) {
+		emit(idx, results[idx])
+	})
+	wait()
+
+	if !reflect.DeepEqual(sink.tickers, tickers) {
+		t.Errorf("sink saw %v, want %v", sink.tickers, tickers)
+	}
+}
+
+func TestStreamSkipsFailedResults(t *testing.T) {
+	viper.Set("workers", 2)
+	t.Cleanup(func() { viper.Set("workers", nil) })
+
+	results := streamResults("A", "B", "C")
+	results[1].Quotes = nil
+	results[1].Err = errors.New("download failed")
+	sink := &recordingSink{}
+
+	emit, wait := stream(context.Background(), sink)
+	emit(1, results[1])
+	emit(2, results[2])
+	emit(0, results[0])
+	wait()
+
+	if want := []string{"A", "C"}; !reflect.DeepEqual(sink.tickers, want) {
+		t.Errorf("sink saw %v, want %v", sink.tickers, want)
+	}
+}
+
+// partialFailSink fails every write of a partial result
+type partialFailSink struct {
+	recordingSink
+}
+
+func (s *partialFailSink) Write(ctx context.Context, result *AssetResult) error {
+	if result.Partial {
+		return errors.New("write failed")
+	}
+	return s.recordingSink.Write(ctx, result)
+}
+
+func TestStreamPartialResults(t *testing.T) {
+	viper.Set("workers", 2)
+	t.Cleanup(func() { viper.Set("workers", nil) })
+
+	a := &Asset{Ticker: "A"}
+	b := &Asset{Ticker: "B"}
+	partial := func(asset *Asset) *AssetResult {
+		return &AssetResult{Asset: asset, Quotes: quotesOn("2022-01-03"), Partial: true}
+	}
+	sink := &recordingSink{}
+
+	emit, wait := stream(context.Background(), sink)
+	emit(1, partial(b))
+	emit(0, partial(a))
+	emit(1, partial(b))
+	emit(0, &AssetResult{Asset: a})
+	emit(1, partial(b))
+	emit(1, &AssetResult{Asset: b})
+	wait()
+
+	if want := []string{"A", "A", "B", "B", "B", "B"}; !reflect.DeepEqual(sink.tickers, want) {
+		t.Errorf("sink saw %v, want %v", sink.tickers, want)
+	}
+}
+
+func TestStreamPartialWriteFails(t *testing.T) {
+	viper.Set("workers", 1)
+	t.Cleanup(func() { viper.Set("workers", nil) })
+
+	asset := &Asset{Ticker: "A"}
+	final := &AssetResult{Asset: asset}
+	sink := &partialFailSink{}
+
+	emit, wait := stream(context.Background(), sink)
+	emit(0, &AssetResult{Asset: asset, Quotes: quotesOn("2022-01-03"), Partial: true})
+	emit(0, final)
+	wait()
+
+	if !final.Failed() {
+		t.Error("asset whose partial result could not be written is not marked as failed")
+	}
+	if want := []string{"A"}; !reflect.DeepEqual(sink.tickers, want) {
+		t.Errorf("sink saw %v, want %v", sink.tickers, want)
+	}
+}
+
+func TestStreamCanceledGap(t *testing.T) {
+	viper.Set("workers", 1)
+	t.Cleanup(func() { viper.Set("workers", nil) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	results := streamResults("A", "B", "C", "D")
+	sink := &recordingSink{}
+
+	emit, wait := stream(ctx, sink)
+	emit(0, results[0])
+	emit(2, results[2])
+
+	// asset 1 is never started; the buffer is full so emitting asset 3
+	// blocks until the run is canceled
+	emitted := make(chan struct{})
+	go func() {
+		emit(3, results[3])
+		close(emitted)
+	}()
+	cancel()
+	<-emitted
+	wait()
+
+	if want := []string{"A", "C", "D"}; !reflect.DeepEqual(sink.tickers, want) {
+		t.Errorf("sink saw %v, want %v", sink.tickers, want)
+	}
+}
@@ -0,0 +1,169 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fred
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+var (
+	ErrNotSupported  = errors.New("operation not supported by source")
+	ErrUnknownSource = errors.New("unknown source")
+	ErrNoSource      = errors.New("no source configured for asset type")
+)
+
+// Series describes a time series published by a source
+type Series struct {
+	ID                      string    `json:"id"`
+	Title                   string    `json:"title"`
+	Units                   string    `json:"units"`
+	UnitsShort              string    `json:"unitsShort"`
+	Frequency               string    `json:"frequency"`
+	FrequencyShort          string    `json:"frequencyShort"`
+	SeasonalAdjustment      string    `json:"seasonalAdjustment"`
+	SeasonalAdjustmentShort string    `json:"seasonalAdjustmentShort"`
+	ObservationStart        time.Time `json:"observationStart"`
+	ObservationEnd          time.Time `json:"observationEnd"`
+	LastUpdated             time.Time `json:"lastUpdated"`
+	Popularity              int       `json:"popularity"`
+	Notes                   string    `json:"notes"`
+
+	// Transformation is the FRED units transformation applied to the
+	// underlying series, e.g. pc1; it is empty for levels
+	Transformation string `json:"transformation,omitempty"`
+}
+
+// SeriesFilter restricts the series returned by Source.ListSeries
+type SeriesFilter struct {
+	// Query is a free-text search over the series id and title
+	Query string
+
+	// Frequency limits results to series with the given native frequency,
+	// e.g. Daily or Monthly. Empty matches all frequencies.
+	Frequency string
+
+	// Limit is the maximum number of series to return
+	Limit int
+}
+
+// Source is a provider of economic time series. Each source serves the
+// assets whose asset_type matches AssetType.
+type Source interface {
+	// Name is the identifier used to select the source in configuration
+	Name() string
+
+	// AssetType is the value of assets.asset_type handled by the source
+	AssetType() string
+
+	// Exchange is recorded on each quote produced by the source
+	Exchange() string
+
+	// Label is stored in eod.source for each quote produced by the source
+	Label() string
+
+	// ListSeries returns the series published by the source that match
+	// the filter
+	ListSeries(ctx context.Context, filter SeriesFilter) ([]*Series, error)
+
+	// Observations returns the observations of a series between start
+	// and end (inclusive) at the given frequency
+	Observations(ctx context.Context, seriesID string, start, end time.Time, freq Frequency) ([]*Observation, error)
+
+	// DescribeSeries returns metadata about a series
+	DescribeSeries(ctx context.Context, seriesID string) (*Series, error)
+}
+
+// VintageSource is implemented by sources that publish the history of
+// revisions to their observations
+type VintageSource interface {
+	Source
+
+	// Vintages returns every real-time period of the observations of a
+	// series between start and end (inclusive) at the given frequency
+	Vintages(ctx context.Context, seriesID string, start, end time.Time, freq Frequency) ([]*Observation, error)
+
+	// VintagesAvailable returns an error when vintages cannot be
+	// downloaded with the current configuration, e.g. without an api key
+	VintagesAvailable() error
+}
+
+// SourceFactory creates a source from the current configuration
+type SourceFactory func() (Source, error)
+
+// sourceFactories are the sources available for selection by name in the
+// `sources` configuration value
+var sourceFactories = map[string]SourceFactory{
+	SourceFRED: NewFREDSourceFromConfig,
+}
+
+// NewSource creates the source registered under name
+func NewSource(name string) (Source, error) {
+	factory, ok := sourceFactories[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownSource, name)
+	}
+	return factory()
+}
+
+// Sources routes assets to the source registered for their asset type
+type Sources map[string]Source
+
+// NewSourcesFromConfig creates each source listed in the `sources`
+// configuration value
+func NewSourcesFromConfig() (Sources, error) {
+	names := viper.GetStringSlice("sources")
+	if len(names) == 0 {
+		names = []string{SourceFRED}
+	}
+
+	sources := make(Sources, len(names))
+	for _, name := range names {
+		src, err := NewSource(name)
+		if err != nil {
+			return nil, err
+		}
+
+		sources[src.AssetType()] = src
+	}
+
+	return sources, nil
+}
+
+// AssetTypes returns the sorted asset types handled by the configured sources
+func (s Sources) AssetTypes() []string {
+	types := make([]string, 0, len(s))
+	for assetType := range s {
+		types = append(types, assetType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// For returns the source responsible for the given asset
+func (s Sources) For(asset *Asset) (Source, error) {
+	src, ok := s[asset.AssetType]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNoSource, asset.AssetType)
+	}
+	return src, nil
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fred
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// stubSource is a FRED source that serves another asset type
+type stubSource struct {
+	*FREDSource
+	assetType string
+}
+
+func (s *stubSource) AssetType() string { return s.assetType }
+
+func TestNewSourcesFromConfig(t *testing.T) {
+	sourceFactories["stub"] = func() (Source, error) {
+		return &stubSource{FREDSource: NewFREDSource(NewGraphClient(), nil), assetType: "STUB"}, nil
+	}
+	t.Cleanup(func() {
+		delete(sourceFactories, "stub")
+		viper.Set("sources", nil)
+	})
+
+	tests := []struct {
+		name       string
+		sources    []string
+		assetTypes []string
+		err        error
+	}{
+		{"default", nil, []string{AssetTypeFRED}, nil},
+		{"fred", []string{"fred"}, []string{AssetTypeFRED}, nil},
+		{"case insensitive", []string{"FRED"}, []string{AssetTypeFRED}, nil},
+		{"multiple sources", []string{"stub", "fred"}, []string{AssetTypeFRED, "STUB"}, nil},
+		{"unknown source", []string{"fred", "bls"}, nil, ErrUnknownSource},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			viper.Set("sources", tt.sources)
+
+			sources, err := NewSourcesFromConfig()
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("NewSourcesFromConfig() error = %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+
+			if got := sources.AssetTypes(); !reflect.DeepEqual(got, tt.assetTypes) {
+				t.Errorf("AssetTypes() = %v, want %v", got, tt.assetTypes)
+			}
+		})
+	}
+}
+
+func TestSourcesFor(t *testing.T) {
+	fredSrc := NewFREDSource(NewGraphClient(), nil)
+	stub := &stubSource{FREDSource: fredSrc, assetType: "STUB"}
+	sources := Sources{AssetTypeFRED: fredSrc, "STUB": stub}
+
+	tests := []struct {
+		name      string
+		assetType string
+		want      Source
+		err       error
+	}{
+		{"fred", AssetTypeFRED, fredSrc, nil},
+		{"other source", "STUB", stub, nil},
+		{"no source", "Common Stock", nil, ErrNoSource},
+		{"asset type is case sensitive", "fred", nil, ErrNoSource},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, err := sources.For(&Asset{Ticker: "DGS10", AssetType: tt.assetType})
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("For() error = %v, want %v", err, tt.err)
+			}
+			if src != tt.want {
+				t.Errorf("For() = %v, want %v", src, tt.want)
+			}
+		})
+	}
+}
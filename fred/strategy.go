@@ -0,0 +1,180 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fred
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	FillForward = "forward"
+	FillLinear  = "linear"
+	FillNone    = "none"
+)
+
+var ErrUnknownFillStrategy = errors.New("unknown fill strategy")
+
+// FillStrategy computes synthetic values for trading days that have no
+// observation
+type FillStrategy interface {
+	// Name identifies the strategy in configuration
+	Name() string
+
+	// Fill returns a value for each trading day without an observation.
+	// prev is the latest observation before the first trading day and may
+	// be nil. tradingDays and observations must be sorted by date.
+	Fill(tradingDays []time.Time, observations []*Observation, prev *Observation) []*Observation
+}
+
+// gap is a trading day without an observation
+type gap struct {
+	date time.Time
+
+	// prev and next are the closest observations before and after the
+	// gap; either may be nil
+	prev *Observation
+	next *Observation
+
+	// stale is the number of trading days since prev, including this one
+	stale int
+}
+
+// findGaps returns the trading days without an observation. Trading days
+// before the first known observation are not gaps.
+func findGaps(tradingDays []time.Time, observations []*Observation, prev *Observation) []*gap {
+	gaps := make([]*gap, 0)
+
+	obsIdx := 0
+	stale := 0
+	for _, dt := range tradingDays {
+		for obsIdx < len(observations) && !observations[obsIdx].Date.After(dt) {
+			prev = observations[obsIdx]
+			stale = 0
+			obsIdx++
+		}
+
+		if prev == nil || !dt.After(prev.Date) {
+			continue
+		}
+
+		stale++
+		g := &gap{date: dt, prev: prev, stale: stale}
+		if obsIdx < len(observations) {
+			g.next = observations[obsIdx]
+		}
+		gaps = append(gaps, g)
+	}
+
+	return gaps
+}
+
+// ForwardFillStrategy propagates the previous observation forward. If
+// MaxStaleDays is positive gaps more than MaxStaleDays trading days after
+// the last observation are left empty.
+type ForwardFillStrategy struct {
+	MaxStaleDays int
+}
+
+func (s *ForwardFillStrategy) Name() string { return FillForward }
+
+func (s *ForwardFillStrategy) Fill(tradingDays []time.Time, observations []*Observation, prev *Observation) []*Observation {
+	fills := make([]*Observation, 0)
+	for _, g := range findGaps(tradingDays, observations, prev) {
+		if s.MaxStaleDays > 0 && g.stale > s.MaxStaleDays {
+			continue
+		}
+		fills = append(fills, &Observation{Date: g.date, Value: g.prev.Value})
+	}
+	return fills
+}
+
+// LinearFillStrategy linearly interpolates between the surrounding
+// observations. Gaps after the last observation are forward-filled. If
+// MaxStaleDays is positive gaps more than MaxStaleDays trading days after
+// the last observation are left empty.
+type LinearFillStrategy struct {
+	MaxStaleDays int
+}
+
+func (s *LinearFillStrategy) Name() string { return FillLinear }
+
+func (s *LinearFillStrategy) Fill(tradingDays []time.Time, observations []*Observation, prev *Observation) []*Observation {
+	fills := make([]*Observation, 0)
+	for _, g := range findGaps(tradingDays, observations, prev) {
+		if s.MaxStaleDays > 0 && g.stale > s.MaxStaleDays {
+			continue
+		}
+
+		val := g.prev.Value
+		if g.next != nil {
+			span := g.next.Date.Sub(g.prev.Date).Hours()
+			elapsed := g.date.Sub(g.prev.Date).Hours()
+			val = g.prev.Value + (g.next.Value-g.prev.Value)*elapsed/span
+		}
+		fills = append(fills, &Observation{Date: g.date, Value: val})
+	}
+	return fills
+}
+
+// NoFillStrategy never creates synthetic values
+type NoFillStrategy struct{}
+
+func (s *NoFillStrategy) Name() string { return FillNone }
+
+func (s *NoFillStrategy) Fill(tradingDays []time.Time, observations []*Observation, prev *Observation) []*Observation {
+	return []*Observation{}
+}
+
+// ParseFillStrategy parses a strategy specification of the form
+// `name[:maxStaleDays]`, e.g. `forward`, `linear:5` or `none`
+func ParseFillStrategy(spec string) (FillStrategy, error) {
+	name, staleStr, hasStale := strings.Cut(strings.TrimSpace(spec), ":")
+
+	maxStale := viper.GetInt("fill.max_stale_days")
+	if hasStale {
+		var err error
+		if maxStale, err = strconv.Atoi(staleStr); err != nil {
+			return nil, fmt.Errorf("invalid max stale days in fill strategy %q: %w", spec, err)
+		}
+	}
+
+	switch strings.ToLower(name) {
+	case FillForward, "":
+		return &ForwardFillStrategy{MaxStaleDays: maxStale}, nil
+	case FillLinear:
+		return &LinearFillStrategy{MaxStaleDays: maxStale}, nil
+	case FillNone:
+		return &NoFillStrategy{}, nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownFillStrategy, name)
+	}
+}
+
+// FillStrategyFor returns the fill strategy configured for the asset in
+// `fill.series.<ticker>`, falling back to `fill.strategy`
+func FillStrategyFor(asset *Asset) (FillStrategy, error) {
+	spec := viper.GetString("fill.strategy")
+	if override := viper.GetStringMapString("fill.series")[strings.ToLower(asset.Ticker)]; override != "" {
+		spec = override
+	}
+	return ParseFillStrategy(spec)
+}
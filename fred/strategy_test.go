@@ -0,0 +1,235 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fred
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// day returns the n-th of January 2024; day(0) is December 31, 2023
+func day(n int) time.Time {
+	return time.Date(2024, 1, n, 0, 0, 0, 0, time.UTC)
+}
+
+func days(ns ...int) []time.Time {
+	result := make([]time.Time, len(ns))
+	for idx, n := range ns {
+		result[idx] = day(n)
+	}
+	return result
+}
+
+func obs(n int, val float64) *Observation {
+	return &Observation{Date: day(n), Value: val}
+}
+
+// fillValues maps the day of each fill to its value
+func fillValues(fills []*Observation) map[int]float64 {
+	values := make(map[int]float64, len(fills))
+	for _, fill := range fills {
+		values[fill.Date.Day()] = fill.Value
+	}
+	return values
+}
+
+func TestFindGaps(t *testing.T) {
+	type wantGap struct {
+		day   int
+		prev  int
+		next  int // 0 means no next observation
+		stale int
+	}
+
+	tests := []struct {
+		name         string
+		observations []*Observation
+		prev         *Observation
+		want         []wantGap
+	}{
+		{
+			name:         "leading days without a previous observation are not gaps",
+			observations: []*Observation{obs(3, 1)},
+			want:         []wantGap{{4, 3, 0, 1}, {5, 3, 0, 2}},
+		},
+		{
+			name:         "previous observation before the window",
+			observations: []*Observation{obs(3, 1)},
+			prev:         &Observation{Date: day(0), Value: 0},
+			want:         []wantGap{{1, 31, 3, 1}, {2, 31, 3, 2}, {4, 3, 0, 1}, {5, 3, 0, 2}},
+		},
+		{
+			name:         "gap between observations",
+			observations: []*Observation{obs(1, 1), obs(4, 4)},
+			want:         []wantGap{{2, 1, 4, 1}, {3, 1, 4, 2}, {5, 4, 0, 1}},
+		},
+		{
+			name: "no observations",
+			want: []wantGap{},
+		},
+		{
+			name:         "every day observed",
+			observations: []*Observation{obs(1, 1), obs(2, 2), obs(3, 3), obs(4, 4), obs(5, 5)},
+			want:         []wantGap{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gaps := findGaps(days(1, 2, 3, 4, 5), tt.observations, tt.prev)
+			if len(gaps) != len(tt.want) {
+				t.Fatalf("got %d gaps, want %d", len(gaps), len(tt.want))
+			}
+
+			for idx, g := range gaps {
+				want := tt.want[idx]
+				if g.date.Day() != want.day || g.prev.Date.Day() != want.prev || g.stale != want.stale {
+					t.Errorf("gap %d = day %d prev %d stale %d, want %+v", idx, g.date.Day(), g.prev.Date.Day(), g.stale, want)
+				}
+				if (g.next == nil) != (want.next == 0) || (g.next != nil && g.next.Date.Day() != want.next) {
+					t.Errorf("gap %d next = %v, want day %d", idx, g.next, want.next)
+				}
+			}
+		})
+	}
+}
+
+func TestFillStrategies(t *testing.T) {
+	tradingDays := days(1, 2, 3, 4, 5, 6)
+
+	tests := []struct {
+		name         string
+		strategy     FillStrategy
+		observations []*Observation
+		prev         *Observation
+		want         map[int]float64
+	}{
+		{
+			name:         "forward",
+			strategy:     &ForwardFillStrategy{},
+			observations: []*Observation{obs(2, 2), obs(5, 5)},
+			want:         map[int]float64{3: 2, 4: 2, 6: 5},
+		},
+		{
+			name:         "forward from previous observation",
+			strategy:     &ForwardFillStrategy{},
+			observations: []*Observation{obs(3, 3)},
+			prev:         &Observation{Date: day(0), Value: 1},
+			want:         map[int]float64{1: 1, 2: 1, 4: 3, 5: 3, 6: 3},
+		},
+		{
+			name:         "forward max stale",
+			strategy:     &ForwardFillStrategy{MaxStaleDays: 2},
+			observations: []*Observation{obs(1, 1)},
+			want:         map[int]float64{2: 1, 3: 1},
+		},
+		{
+			name:         "linear",
+			strategy:     &LinearFillStrategy{},
+			observations: []*Observation{obs(1, 1), obs(5, 5)},
+			want:         map[int]float64{2: 2, 3: 3, 4: 4, 6: 5},
+		},
+		{
+			name:         "linear single observation",
+			strategy:     &LinearFillStrategy{},
+			observations: []*Observation{obs(4, 4)},
+			want:         map[int]float64{5: 4, 6: 4},
+		},
+		{
+			name:         "linear max stale",
+			strategy:     &LinearFillStrategy{MaxStaleDays: 1},
+			observations: []*Observation{obs(1, 1), obs(4, 4)},
+			want:         map[int]float64{2: 2, 5: 4},
+		},
+		{
+			name:         "none",
+			strategy:     &NoFillStrategy{},
+			observations: []*Observation{obs(1, 1)},
+			want:         map[int]float64{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := fillValues(tt.strategy.Fill(tradingDays, tt.observations, tt.prev))
+			if len(got) != len(tt.want) {
+				t.Fatalf("fills = %v, want %v", got, tt.want)
+			}
+			for d, val := range tt.want {
+				if got[d] != val {
+					t.Errorf("fill on day %d = %v, want %v", d, got[d], val)
+				}
+			}
+		})
+	}
+}
+
+func TestParseFillStrategy(t *testing.T) {
+	viper.Set("fill.max_stale_days", 10)
+	t.Cleanup(func() { viper.Set("fill.max_stale_days", nil) })
+
+	tests := []struct {
+		spec     string
+		name     string
+		maxStale int
+		err      error
+	}{
+		{spec: "", name: FillForward, maxStale: 10},
+		{spec: "forward", name: FillForward, maxStale: 10},
+		{spec: " Linear ", name: FillLinear, maxStale: 10},
+		{spec: "linear:5", name: FillLinear, maxStale: 5},
+		{spec: "forward:0", name: FillForward, maxStale: 0},
+		{spec: "none", name: FillNone},
+		{spec: "cubic", err: ErrUnknownFillStrategy},
+		{spec: "forward:many"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			strategy, err := ParseFillStrategy(tt.spec)
+			if tt.name == "" {
+				if err == nil {
+					t.Fatalf("ParseFillStrategy(%q) = %v, want error", tt.spec, strategy)
+				}
+				if tt.err != nil && !errors.Is(err, tt.err) {
+					t.Errorf("ParseFillStrategy(%q) error = %v, want %v", tt.spec, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseFillStrategy(%q) error = %v", tt.spec, err)
+			}
+
+			if strategy.Name() != tt.name {
+				t.Errorf("Name() = %s, want %s", strategy.Name(), tt.name)
+			}
+
+			maxStale := 0
+			switch s := strategy.(type) {
+			case *ForwardFillStrategy:
+				maxStale = s.MaxStaleDays
+			case *LinearFillStrategy:
+				maxStale = s.MaxStaleDays
+			}
+			if maxStale != tt.maxStale {
+				t.Errorf("MaxStaleDays = %d, want %d", maxStale, tt.maxStale)
+			}
+		})
+	}
+}
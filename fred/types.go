@@ -15,23 +15,96 @@ limitations under the License.
 */
 package fred
 
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// EodSchemaVersion identifies the layout of Eod in exported files. It is
+// stored in the `schema_version` key-value metadata of parquet files.
+//
+//	1: original layout
+//	2: frequency column added
+//	3: prices stored as DOUBLE
+const EodSchemaVersion = 3
+
 type Eod struct {
 	Date          string  `json:"date" parquet:"name=date, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
 	Ticker        string  `json:"ticker" parquet:"name=ticker, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
 	Exchange      string  `json:"exchange" parquet:"name=exchange, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
 	AssetType     string  `json:"assetType" parquet:"name=assetType, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
 	CompositeFigi string  `json:"compositeFigi" parquet:"name=compositeFigi, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
-	Open          float32 `json:"open" parquet:"name=open, type=FLOAT"`
-	High          float32 `json:"high" parquet:"name=high, type=FLOAT"`
-	Low           float32 `json:"low" parquet:"name=low, type=FLOAT"`
-	Close         float32 `json:"close" parquet:"name=close, type=FLOAT"`
+	Open          float64 `json:"open" parquet:"name=open, type=DOUBLE"`
+	High          float64 `json:"high" parquet:"name=high, type=DOUBLE"`
+	Low           float64 `json:"low" parquet:"name=low, type=DOUBLE"`
+	Close         float64 `json:"close" parquet:"name=close, type=DOUBLE"`
 	Volume        int64   `json:"volume" parquet:"name=volume, type=INT64, convertedtype=INT_64"`
-	Dividend      float32 `json:"divCash" parquet:"name=dividend, type=FLOAT"`
-	Split         float32 `json:"splitFactor" parquet:"name=split, type=FLOAT"`
+	Dividend      float64 `json:"divCash" parquet:"name=dividend, type=DOUBLE"`
+	Split         float64 `json:"splitFactor" parquet:"name=split, type=DOUBLE"`
+	Frequency     string  `json:"frequency" parquet:"name=frequency, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+
+	// Source is the label stored in eod.source; it is not exported to files
+	Source string `json:"-"`
 }
 
 type Asset struct {
 	CompositeFigi string `json:"compositeFigi"`
 	Ticker        string `json:"ticker" csv:"ticker"`
 	AssetType     string `json:"assetType" csv:"assetType"`
+
+	// LastDate is the date of the most recent observation stored for the
+	// asset; it is the zero time when no observations have been stored
+	LastDate time.Time `json:"lastDate"`
+
+	// NativeFrequency is the frequency_short of the series stored in
+	// series_metadata, e.g. M; it is empty when no metadata is stored
+	NativeFrequency string `json:"nativeFrequency,omitempty"`
+
+	// ObservationStart is the date of the first observation of the series
+	// when it is known, e.g. from series_metadata; it is the zero time
+	// otherwise
+	ObservationStart time.Time `json:"observationStart"`
+
+	// Series is the description of the asset published by its source; it
+	// is nil until RefreshMetadata has run
+	Series *Series `json:"series,omitempty"`
+}
+
+// Vintage is a value of an observation during the real-time period in
+// which it was published
+type Vintage struct {
+	Ticker        string    `json:"ticker"`
+	CompositeFigi string    `json:"compositeFigi"`
+	Date          time.Time `json:"date"`
+	RealtimeStart time.Time `json:"realtimeStart"`
+	RealtimeEnd   time.Time `json:"realtimeEnd"`
+	Value         float64   `json:"value"`
+	Source        string    `json:"-"`
+}
+
+// AssetResult reports the outcome of downloading a single asset
+type AssetResult struct {
+	Asset   *Asset
+	Quotes  []*Eod
+	Retries int
+	Err     error
+
+	// Vintages is only populated in vintage mode
+	Vintages []*Vintage
+
+	// Partial is set on results that carry part of the observations of
+	// an asset; the final result of the asset follows
+	Partial bool
+}
+
+// Failed reports whether the asset could not be downloaded
+func (r *AssetResult) Failed() bool {
+	return r.Err != nil
+}
+
+// Canceled reports whether the asset was skipped because the run was
+// stopped before it started
+func (r *AssetResult) Canceled() bool {
+	return errors.Is(r.Err, context.Canceled)
 }
@@ -0,0 +1,82 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fred
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// UnitsLevels is the untransformed value of a series
+const UnitsLevels = "lin"
+
+var ErrUnknownUnits = errors.New("unknown units transformation")
+
+// unitsDescriptions maps each FRED units transformation to the
+// description FRED uses for it
+var unitsDescriptions = map[string]string{
+	UnitsLevels: "Levels",
+	"chg":       "Change",
+	"ch1":       "Change from Year Ago",
+	"pch":       "Percent Change",
+	"pc1":       "Percent Change from Year Ago",
+	"pca":       "Compounded Annual Rate of Change",
+	"cch":       "Continuously Compounded Rate of Change",
+	"cca":       "Continuously Compounded Annual Rate of Change",
+	"log":       "Natural Log",
+}
+
+// SplitTicker separates a derived ticker of the form `SERIES:units`, e.g.
+// CPIAUCSL:pc1, into the FRED series id and the units transformation. The
+// units are empty for plain series and for the levels transformation.
+func SplitTicker(ticker string) (seriesID, units string, err error) {
+	seriesID, units, _ = strings.Cut(strings.TrimSpace(ticker), ":")
+	seriesID = strings.ToUpper(seriesID)
+	units = strings.ToLower(units)
+
+	if _, ok := unitsDescriptions[units]; units != "" && !ok {
+		return "", "", fmt.Errorf("%w: %s", ErrUnknownUnits, units)
+	}
+	if units == UnitsLevels {
+		units = ""
+	}
+
+	return seriesID, units, nil
+}
+
+// CanonicalTicker returns the ticker under which a series is stored: the
+// series id in upper case followed by the lower case units transformation,
+// if any
+func CanonicalTicker(ticker string) (string, error) {
+	seriesID, units, err := SplitTicker(ticker)
+	if err != nil || units == "" {
+		return seriesID, err
+	}
+	return seriesID + ":" + units, nil
+}
+
+// transformSeries describes the derived series produced by applying units
+// to series
+func transformSeries(series *Series, units string) *Series {
+	derived := *series
+	derived.ID = series.ID + ":" + units
+	derived.Title = series.Title + " (" + unitsDescriptions[units] + ")"
+	derived.Units = unitsDescriptions[units]
+	derived.UnitsShort = unitsDescriptions[units]
+	derived.Transformation = units
+	return &derived
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fred
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSplitTicker(t *testing.T) {
+	tests := []struct {
+		ticker   string
+		seriesID string
+		units    string
+		err      error
+	}{
+		{"DGS10", "DGS10", "", nil},
+		{"dgs10", "DGS10", "", nil},
+		{" CPIAUCSL:pc1 ", "CPIAUCSL", "pc1", nil},
+		{"cpiaucsl:PC1", "CPIAUCSL", "pc1", nil},
+		{"GDP:lin", "GDP", "", nil},
+		{"GDP:", "GDP", "", nil},
+		{"GDP:log", "GDP", "log", nil},
+		{"GDP:xyz", "", "", ErrUnknownUnits},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ticker, func(t *testing.T) {
+			seriesID, units, err := SplitTicker(tt.ticker)
+			if !errors.Is(err, tt.err) || (tt.err == nil && err != nil) {
+				t.Fatalf("SplitTicker(%q) error = %v, want %v", tt.ticker, err, tt.err)
+			}
+			if seriesID != tt.seriesID || units != tt.units {
+				t.Errorf("SplitTicker(%q) = (%q, %q), want (%q, %q)", tt.ticker, seriesID, units, tt.seriesID, tt.units)
+			}
+		})
+	}
+}
+
+func TestCanonicalTicker(t *testing.T) {
+	tests := []struct {
+		ticker string
+		want   string
+		err    error
+	}{
+		{"DGS10", "DGS10", nil},
+		{"unrate", "UNRATE", nil},
+		{"cpiaucsl:PC1", "CPIAUCSL:pc1", nil},
+		{"GDP:lin", "GDP", nil},
+		{"GDP:bogus", "", ErrUnknownUnits},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ticker, func(t *testing.T) {
+			got, err := CanonicalTicker(tt.ticker)
+			if !errors.Is(err, tt.err) || (tt.err == nil && err != nil) {
+				t.Fatalf("CanonicalTicker(%q) error = %v, want %v", tt.ticker, err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("CanonicalTicker(%q) = %q, want %q", tt.ticker, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransformSeries(t *testing.T) {
+	series := &Series{
+		ID:         "CPIAUCSL",
+		Title:      "Consumer Price Index",
+		Units:      "Index 1982-1984=100",
+		UnitsShort: "Index",
+		Frequency:  "Monthly",
+	}
+
+	tests := []struct {
+		units string
+		id    string
+		title string
+		desc  string
+	}{
+		{"pc1", "CPIAUCSL:pc1", "Consumer Price Index (Percent Change from Year Ago)", "Percent Change from Year Ago"},
+		{"log", "CPIAUCSL:log", "Consumer Price Index (Natural Log)", "Natural Log"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.units, func(t *testing.T) {
+			got := transformSeries(series, tt.units)
+			if got.ID != tt.id || got.Title != tt.title {
+				t.Errorf("transformSeries() = {%q %q}, want {%q %q}", got.ID, got.Title, tt.id, tt.title)
+			}
+			if got.Units != tt.desc || got.UnitsShort != tt.desc || got.Transformation != tt.units {
+				t.Errorf("transformSeries() units = {%q %q %q}, want {%q %q %q}", got.Units, got.UnitsShort, got.Transformation, tt.desc, tt.desc, tt.units)
+			}
+			if got.Frequency != series.Frequency {
+				t.Errorf("transformSeries() frequency = %q, want %q", got.Frequency, series.Frequency)
+			}
+		})
+	}
+
+	if series.ID != "CPIAUCSL" || series.Title != "Consumer Price Index" || series.Transformation != "" {
+		t.Errorf("transformSeries() modified the original series: %+v", series)
+	}
+}
@@ -0,0 +1,259 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fred
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// eod_vintage is bitemporal: each row is the value of an observation
+// during the real-time period [realtime_start, realtime_end]
+const eodVintageTable = `CREATE TABLE IF NOT EXISTS eod_vintage (
+	composite_figi TEXT NOT NULL,
+	ticker TEXT NOT NULL,
+	event_date DATE NOT NULL,
+	realtime_start DATE NOT NULL,
+	realtime_end DATE NOT NULL,
+	value DOUBLE PRECISION NOT NULL,
+	source TEXT NOT NULL,
+	PRIMARY KEY (composite_figi, event_date, realtime_start)
+)`
+
+// vintageMode reports whether vintages should be downloaded
+func vintageMode() bool {
+	return viper.GetBool("vintage.enabled")
+}
+
+// CheckVintages returns an error when vintage mode is enabled and one of
+// sources that publishes vintages cannot download them. Runs check this
+// once before starting so that every asset does not fail on its own.
+func CheckVintages(sources Sources) error {
+	if !vintageMode() {
+		return nil
+	}
+
+	for _, assetType := range sources.AssetTypes() {
+		vs, ok := sources[assetType].(VintageSource)
+		if !ok {
+			continue
+		}
+		if err := vs.VintagesAvailable(); err != nil {
+			return fmt.Errorf("%s source cannot download vintages: %w", vs.Name(), err)
+		}
+	}
+	return nil
+}
+
+// download retrieves the observations of a series for one request window.
+// In vintage mode every real-time period is requested from sources that
+// support it and the current values are derived from the latest period of
+// each observation; otherwise vintages is nil.
+func download(ctx context.Context, src Source, seriesID string, start, end time.Time, freq Frequency) (current, vintages []*Observation, err error) {
+	if vs, ok := src.(VintageSource); ok && vintageMode() {
+		vintages, err = vs.Vintages(ctx, seriesID, start, end, freq)
+		if err != nil {
+			return nil, nil, err
+		}
+		return latestVintages(vintages), vintages, nil
+	}
+
+	current, err = src.Observations(ctx, seriesID, start, end, freq)
+	return current, nil, err
+}
+
+// latestVintages returns the most recently published value of each
+// observation date. vintages must be sorted by date.
+func latestVintages(vintages []*Observation) []*Observation {
+	current := make([]*Observation, 0, len(vintages))
+	for _, v := range vintages {
+		last := len(current) - 1
+		switch {
+		case last >= 0 && current[last].Date.Equal(v.Date):
+			if v.RealtimeStart.After(current[last].RealtimeStart) {
+				current[last] = v
+			}
+		default:
+			current = append(current, v)
+		}
+	}
+
+	// vintages that have been superseded without replacement are no
+	// longer part of the series
+	latest := make([]*Observation, 0, len(current))
+	for _, v := range current {
+		if v.RealtimeEnd.Equal(RealtimeOpenEnd) {
+			latest = append(latest, &Observation{Date: v.Date, Value: v.Value})
+		}
+	}
+	return latest
+}
+
+func observationsToVintages(src Source, asset *Asset, observations []*Observation) []*Vintage {
+	vintages := make([]*Vintage, 0, len(observations))
+	for _, obs := range observations {
+		vintages = append(vintages, &Vintage{
+			Ticker:        asset.Ticker,
+			CompositeFigi: asset.CompositeFigi,
+			Date:          obs.Date,
+			RealtimeStart: obs.RealtimeStart,
+			RealtimeEnd:   obs.RealtimeEnd,
+			Value:         obs.Value,
+			Source:        src.Label(),
+		})
+	}
+	return vintages
+}
+
+// saveVintages upserts vintages in a single transaction
+func saveVintages(ctx context.Context, conn *pgx.Conn, vintages []*Vintage) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// no-op once the transaction has been committed
+		_ = tx.Rollback(context.WithoutCancel(ctx))
+	}()
+
+	for start := 0; start < len(vintages); start += upsertBatchSize {
+		end := start + upsertBatchSize
+		if end > len(vintages) {
+			end = len(vintages)
+		}
+
+		batch := &pgx.Batch{}
+		for _, v := range vintages[start:end] {
+			batch.Queue(`INSERT INTO eod_vintage (
+				composite_figi,
+				ticker,
+				event_date,
+				realtime_start,
+				realtime_end,
+				value,
+				source
+			) VALUES ($1, $2, $3, $4, $5, $6, $7)
+			ON CONFLICT (composite_figi, event_date, realtime_start) DO UPDATE SET
+				realtime_end = EXCLUDED.realtime_end,
+				value = EXCLUDED.value,
+				source = EXCLUDED.source`,
+				v.CompositeFigi, v.Ticker, v.Date, v.RealtimeStart, v.RealtimeEnd, v.Value, v.Source)
+		}
+
+		if err = tx.SendBatch(ctx, batch).Close(); err != nil {
+			log.Error().Err(err).Msg("error saving vintages to database")
+			return err
+		}
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		log.Error().Err(err).Msg("transaction commit failed")
+		return err
+	}
+
+	return nil
+}
+
+// asKnownOnQuery selects the value of each observation of an asset as it
+// was published on $4, i.e. without any revisions made after that date
+const asKnownOnQuery = `SELECT event_date, value, realtime_start, realtime_end, source
+FROM eod_vintage
+WHERE composite_figi = $1 AND event_date >= $2::date AND event_date <= $3::date
+	AND realtime_start <= $4::date AND realtime_end >= $4::date
+ORDER BY event_date ASC`
+
+// AsKnownOn returns the quotes of asset between since and until (inclusive)
+// with the values that were current on asOf, i.e. without any revisions
+// published after that date, for point-in-time backtests. Only series
+// downloaded in vintage mode have any. Quotes are labeled with the
+// frequency the asset is downloaded at, which falls back to its native
+// frequency as in Fetch.
+func AsKnownOn(ctx context.Context, conn *pgx.Conn, asset *Asset, since, until, asOf time.Time) ([]*Eod, error) {
+	freq, err := vintageFrequency(ctx, conn, asset)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := conn.Query(ctx, asKnownOnQuery, asset.CompositeFigi, since, until, asOf)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	vintages := make([]*Vintage, 0, 252)
+	for rows.Next() {
+		v := &Vintage{Ticker: asset.Ticker, CompositeFigi: asset.CompositeFigi}
+		if err = rows.Scan(&v.Date, &v.Value, &v.RealtimeStart, &v.RealtimeEnd, &v.Source); err != nil {
+			return nil, err
+		}
+		vintages = append(vintages, v)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return vintagesToEod(asset, freq, vintages), nil
+}
+
+// vintageFrequency returns the frequency asset is downloaded at. The
+// native frequency is read from series_metadata when the asset was
+// loaded without it.
+func vintageFrequency(ctx context.Context, conn *pgx.Conn, asset *Asset) (Frequency, error) {
+	if asset.NativeFrequency != "" {
+		return FrequencyFor(asset)
+	}
+
+	var native *string
+	err := conn.QueryRow(ctx, `SELECT frequency_short FROM series_metadata WHERE composite_figi = $1`, asset.CompositeFigi).Scan(&native)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return Frequency{}, err
+	}
+
+	withNative := *asset
+	if native != nil {
+		withNative.NativeFrequency = *native
+	}
+	return FrequencyFor(&withNative)
+}
+
+// vintagesToEod converts vintages to quotes at frequency freq. ALFRED is
+// the only source of vintages, so quotes are labeled with ExchangeFRED.
+func vintagesToEod(asset *Asset, freq Frequency, vintages []*Vintage) []*Eod {
+	quotes := make([]*Eod, 0, len(vintages))
+	for _, v := range vintages {
+		quotes = append(quotes, &Eod{
+			Date:          v.Date.Format("2006-01-02"),
+			Ticker:        asset.Ticker,
+			Exchange:      ExchangeFRED,
+			AssetType:     asset.AssetType,
+			CompositeFigi: asset.CompositeFigi,
+			Open:          v.Value,
+			High:          v.Value,
+			Low:           v.Value,
+			Close:         v.Value,
+			Split:         1,
+			Frequency:     freq.String(),
+			Source:        v.Source,
+		})
+	}
+	return quotes
+}
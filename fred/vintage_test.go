@@ -0,0 +1,244 @@
+/*
+Copyright 2022
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package fred
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestLatestVintages(t *testing.T) {
+	date := func(s string) time.Time {
+		d, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	vintage := func(obsDate string, value float64, start, end string) *Observation {
+		obs := &Observation{Date: date(obsDate), Value: value, RealtimeStart: date(start), RealtimeEnd: RealtimeOpenEnd}
+		if end != "" {
+			obs.RealtimeEnd = date(end)
+		}
+		return obs
+	}
+
+	type point struct {
+		date  string
+		value float64
+	}
+
+	tests := []struct {
+		name     string
+		vintages []*Observation
+		want     []point
+	}{
+		{
+			name: "no vintages",
+		},
+		{
+			name: "single vintage per date",
+			vintages: []*Observation{
+				vintage("2022-01-01", 1, "2022-02-01", ""),
+				vintage("2022-02-01", 2, "2022-03-01", ""),
+			},
+			want: []point{{"2022-01-01", 1}, {"2022-02-01", 2}},
+		},
+		{
+			name: "superseded period",
+			vintages: []*Observation{
+				vintage("2022-01-01", 1, "2022-02-01", "2022-02-28"),
+				vintage("2022-01-01", 1.5, "2022-03-01", ""),
+			},
+			want: []point{{"2022-01-01", 1.5}},
+		},
+		{
+			name: "several vintages on one date",
+			vintages: []*Observation{
+				vintage("2022-01-01", 1, "2022-02-01", "2022-02-28"),
+				vintage("2022-01-01", 1.2, "2022-03-01", "2022-03-31"),
+				vintage("2022-01-01", 1.3, "2022-04-01", ""),
+				vintage("2022-02-01", 2, "2022-03-01", "2022-03-31"),
+				vintage("2022-02-01", 2.1, "2022-04-01", ""),
+			},
+			want: []point{{"2022-01-01", 1.3}, {"2022-02-01", 2.1}},
+		},
+		{
+			name: "latest period listed first",
+			vintages: []*Observation{
+				vintage("2022-01-01", 1.3, "2022-04-01", ""),
+				vintage("2022-01-01", 1, "2022-02-01", "2022-03-31"),
+			},
+			want: []point{{"2022-01-01", 1.3}},
+		},
+		{
+			name: "withdrawn observation",
+			vintages: []*Observation{
+				vintage("2022-01-01", 1, "2022-02-01", ""),
+				vintage("2022-02-01", 2, "2022-03-01", "2022-03-31"),
+			},
+			want: []point{{"2022-01-01", 1}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := latestVintages(tt.vintages)
+			if len(got) != len(tt.want) {
+				t.Fatalf("latestVintages() returned %d observations, want %d", len(got), len(tt.want))
+			}
+			for idx, w := range tt.want {
+				if got[idx].Date.Format("2006-01-02") != w.date || got[idx].Value != w.value {
+					t.Errorf("observation %d = {%s %v}, want {%s %v}", idx, got[idx].Date.Format("2006-01-02"), got[idx].Value, w.date, w.value)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckVintages(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+		api     *APIClient
+		err     error
+	}{
+		{"disabled without api key", false, nil, nil},
+		{"enabled without api key", true, nil, ErrMissingAPIKey},
+		{"enabled with api key", true, NewAPIClient("key"), nil},
+	}
+
+	t.Cleanup(func() { viper.Set("vintage.enabled", nil) })
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			viper.Set("vintage.enabled", tt.enabled)
+			src := NewFREDSource(NewGraphClient(), tt.api)
+
+			err := CheckVintages(Sources{src.AssetType(): src})
+			if !errors.Is(err, tt.err) || (tt.err == nil && err != nil) {
+				t.Errorf("CheckVintages() error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestVintagesToEod(t *testing.T) {
+	asset := &Asset{Ticker: "GDP", CompositeFigi: "FRED:GDP", AssetType: AssetTypeFRED}
+	freq := Frequency{Period: FrequencyMonthly, Aggregation: AggregationEndOfPeriod}
+	vintages := []*Vintage{
+		{Date: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC), Value: 1.5, Source: "api.stlouisfed.org"},
+		{Date: time.Date(2022, 4, 1, 0, 0, 0, 0, time.UTC), Value: 2.5, Source: "api.stlouisfed.org"},
+	}
+
+	quotes := vintagesToEod(asset, freq, vintages)
+	if len(quotes) != len(vintages) {
+		t.Fatalf("vintagesToEod() returned %d quotes, want %d", len(quotes), len(vintages))
+	}
+
+	for idx, q := range quotes {
+		v := vintages[idx]
+		if q.Date != v.Date.Format("2006-01-02") {
+			t.Errorf("quote %d date = %s, want %s", idx, q.Date, v.Date.Format("2006-01-02"))
+		}
+		if q.Open != v.Value || q.High != v.Value || q.Low != v.Value || q.Close != v.Value {
+			t.Errorf("quote %d = {%v %v %v %v}, want every price %v", idx, q.Open, q.High, q.Low, q.Close, v.Value)
+		}
+		if q.Frequency != freq.String() {
+			t.Errorf("quote %d frequency = %q, want %q", idx, q.Frequency, freq.String())
+		}
+		if q.Split != 1 || q.Ticker != asset.Ticker || q.CompositeFigi != asset.CompositeFigi || q.Exchange != ExchangeFRED || q.Source != v.Source {
+			t.Errorf("quote %d = %+v, labels do not match the asset", idx, q)
+		}
+	}
+}
+
+func TestAsKnownOn(t *testing.T) {
+	conn := testConn(t)
+	ctx := context.Background()
+
+	date := func(s string) time.Time {
+		d, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	vintage := func(obsDate string, value float64, start, end string) *Vintage {
+		v := &Vintage{Ticker: "GDP", CompositeFigi: "FRED:GDP", Date: date(obsDate), Value: value,
+			RealtimeStart: date(start), RealtimeEnd: RealtimeOpenEnd, Source: "api.stlouisfed.org"}
+		if end != "" {
+			v.RealtimeEnd = date(end)
+		}
+		return v
+	}
+
+	err := saveVintages(ctx, conn, []*Vintage{
+		vintage("2022-01-01", 1, "2022-02-01", "2022-02-28"),
+		vintage("2022-01-01", 1.5, "2022-03-01", ""),
+		vintage("2022-04-01", 2, "2022-05-01", ""),
+	})
+	if err != nil {
+		t.Fatalf("saveVintages() error = %v", err)
+	}
+
+	// GDP is published quarterly, so a monthly default falls back to native
+	if _, err = conn.Exec(ctx, `INSERT INTO series_metadata (composite_figi, ticker, source, frequency_short) VALUES ('FRED:GDP', 'GDP', 'fred', 'Q')`); err != nil {
+		t.Fatalf("could not save series metadata: %v", err)
+	}
+	viper.Set("frequency.default", FrequencyMonthly)
+	t.Cleanup(func() { viper.Set("frequency.default", nil) })
+
+	type point struct {
+		date  string
+		value float64
+	}
+
+	tests := []struct {
+		asOf string
+		want []point
+	}{
+		{"2022-01-15", nil},
+		{"2022-02-15", []point{{"2022-01-01", 1}}},
+		{"2022-03-15", []point{{"2022-01-01", 1.5}}},
+		{"2022-06-01", []point{{"2022-01-01", 1.5}, {"2022-04-01", 2}}},
+	}
+
+	asset := &Asset{Ticker: "GDP", CompositeFigi: "FRED:GDP", AssetType: AssetTypeFRED}
+	for _, tt := range tests {
+		t.Run(tt.asOf, func(t *testing.T) {
+			quotes, err := AsKnownOn(ctx, conn, asset, FullHistoryStart, date("2023-01-01"), date(tt.asOf))
+			if err != nil {
+				t.Fatalf("AsKnownOn() error = %v", err)
+			}
+			if len(quotes) != len(tt.want) {
+				t.Fatalf("AsKnownOn() returned %d quotes, want %d", len(quotes), len(tt.want))
+			}
+			for idx, w := range tt.want {
+				if quotes[idx].Date != w.date || quotes[idx].Close != w.value {
+					t.Errorf("quote %d = {%s %v}, want {%s %v}", idx, quotes[idx].Date, quotes[idx].Close, w.date, w.value)
+				}
+				if quotes[idx].Frequency != FrequencyNative {
+					t.Errorf("quote %d frequency = %q, want %q", idx, quotes[idx].Frequency, FrequencyNative)
+				}
+			}
+		})
+	}
+}